@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// AlertAction is a change applied to the alerts a suppression selects. Each
+// action builds its own request and has its own retry policy.
+type AlertAction interface {
+	// Check reports a missing or invalid parameter of rule.
+	Check(rule Suppression) error
+	// Request returns the URL and body of the action on alert, and the
+	// audit entry recorded for each attempt.
+	Request(alert Alert, rule Suppression, config JsonConfig) (string, any, AuditEntry)
+	Retry(config JsonConfig) RetryPolicy
+	// Done names the action in messages: "Closed", "Assigned"...
+	Done() string
+}
+
+// RetryPolicy bounds the attempts of an action. Network errors and the
+// Statuses answers (429 and 5xx when empty) are retried until Attempts is
+// reached, waiting Backoff, doubled after each attempt up to MaxBackoff.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Statuses   []int
+}
+
+// CloseRetry is the retry policy of the config: closeAttempts,
+// closeBackoff, closeBackoffMax and closeRetryStatus.
+func CloseRetry(config JsonConfig) (RetryPolicy, error) {
+	backoff, err := time.ParseDuration(config.CloseBackoff)
+	if err != nil {
+		return RetryPolicy{}, fmt.Errorf("invalid closeBackoff %q", config.CloseBackoff)
+	}
+	maxBackoff, err := time.ParseDuration(config.CloseBackoffMax)
+	if err != nil {
+		return RetryPolicy{}, fmt.Errorf("invalid closeBackoffMax %q", config.CloseBackoffMax)
+	}
+	return RetryPolicy{
+		Attempts:   config.CloseAttempts,
+		Backoff:    backoff,
+		MaxBackoff: maxBackoff,
+		Statuses:   config.CloseRetryStatus,
+	}, nil
+}
+
+// defaultRetry is CloseRetry of a config checked at startup.
+func defaultRetry(config JsonConfig) RetryPolicy {
+	policy, _ := CloseRetry(config)
+	return policy
+}
+
+func (p RetryPolicy) retryable(status int) bool {
+	if len(p.Statuses) == 0 {
+		return status == http.StatusTooManyRequests || status >= 500
+	}
+	return slices.Contains(p.Statuses, status)
+}
+
+// wait is the pause before the attempt following attempt.
+func (p RetryPolicy) wait(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+	return d
+}
+
+// alertActions are the actions a suppression can name, "close" by default.
+var alertActions = map[string]AlertAction{
+	"close":        closeAction{},
+	"inProgress":   statusAction{status: "inProgress"},
+	"assign":       assignAction{},
+	"comment":      commentAction{},
+	"linkIncident": incidentAction{},
+	"tag":          tagAction{},
+}
+
+// StatusRequest changes the status of an alert.
+type StatusRequest struct {
+	ID       string `json:"ID"`
+	TenantID string `json:"TenantID"`
+	Status   string `json:"Status"`
+}
+
+type AssignRequest struct {
+	ID         string `json:"ID"`
+	TenantID   string `json:"TenantID"`
+	AssigneeID string `json:"AssigneeID"`
+}
+
+type CommentRequest struct {
+	ID       string `json:"ID"`
+	TenantID string `json:"TenantID"`
+	Comment  string `json:"Comment"`
+}
+
+type IncidentLinkRequest struct {
+	ID         string `json:"ID"`
+	TenantID   string `json:"TenantID"`
+	IncidentID string `json:"IncidentID"`
+}
+
+type TagRequest struct {
+	ID       string   `json:"ID"`
+	TenantID string   `json:"TenantID"`
+	Tags     []string `json:"Tags"`
+}
+
+// CheckActions validates the action of every suppression.
+func CheckActions(config JsonConfig) error {
+	for _, rule := range config.Suppressions {
+		action, ok := alertActions[rule.Action]
+		if !ok {
+			return fmt.Errorf("suppression %q: unknown action %q", rule.Name, rule.Action)
+		}
+		if err := action.Check(rule); err != nil {
+			return fmt.Errorf("suppression %q: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+// alertRule returns the suppression that matched alert, or the top-level
+// close settings for an alert that did not go through the filters.
+func alertRule(alert Alert, config JsonConfig) Suppression {
+	if alert.suppression != nil {
+		return *alert.suppression
+	}
+	return Suppression{Action: "close", Reason: config.CloseReason, Comment: config.CloseComment}
+}
+
+// applyAction sends the request of the action of the suppression that
+// matched alert.
+func applyAction(ctx context.Context, alert Alert, config JsonConfig, client *http.Client, audit *AuditLog) CloseResult {
+	rule := alertRule(alert, config)
+	action, ok := alertActions[rule.Action]
+	if !ok {
+		result := failedResult(alert, fmt.Errorf("unknown action %q", rule.Action))
+		result.Action = rule.Action
+		return result
+	}
+	url, payload, entry := action.Request(alert, rule, config)
+	entry.Suppression = rule.Name
+	result := postAlertRequest(ctx, alert, url, payload, entry, action.Retry(config), config, client, audit)
+	result.Action = rule.Action
+	return result
+}
+
+func alertURL(config JsonConfig, endpoint string, alert Alert) string {
+	return fmt.Sprintf("%s/alerts/%s?tenantID=%s", config.BaseURL, endpoint, alert.TenantID)
+}
+
+type closeAction struct{}
+
+func (closeAction) Check(rule Suppression) error        { return nil }
+func (closeAction) Retry(config JsonConfig) RetryPolicy { return defaultRetry(config) }
+func (closeAction) Done() string                        { return "Closed" }
+
+func (closeAction) Request(alert Alert, rule Suppression, config JsonConfig) (string, any, AuditEntry) {
+	req, entry := closeRequest(alert, rule)
+	return alertURL(config, "close", alert), req, entry
+}
+
+// closeRequest is the close of alert, shared by single and batch closes.
+func closeRequest(alert Alert, rule Suppression) (CloseRequest, AuditEntry) {
+	req := CloseRequest{ID: alert.InternalID, TenantID: alert.TenantID, Reason: rule.Reason, Comment: rule.Comment}
+	entry := AuditEntry{Action: "close", PreviousStatus: alert.Status, Reason: rule.Reason, Comment: rule.Comment}
+	return req, entry
+}
+
+type statusAction struct {
+	status string
+}
+
+func (statusAction) Check(rule Suppression) error        { return nil }
+func (statusAction) Retry(config JsonConfig) RetryPolicy { return defaultRetry(config) }
+func (a statusAction) Done() string                      { return "Set to " + a.status }
+
+func (a statusAction) Request(alert Alert, rule Suppression, config JsonConfig) (string, any, AuditEntry) {
+	req := StatusRequest{ID: alert.InternalID, TenantID: alert.TenantID, Status: a.status}
+	entry := AuditEntry{Action: rule.Action, PreviousStatus: alert.Status, NewStatus: a.status}
+	return alertURL(config, "status", alert), req, entry
+}
+
+type assignAction struct{}
+
+func (assignAction) Retry(config JsonConfig) RetryPolicy { return defaultRetry(config) }
+func (assignAction) Done() string                        { return "Assigned" }
+
+func (assignAction) Check(rule Suppression) error {
+	if rule.Assignee == "" {
+		return fmt.Errorf("assign needs an assignee")
+	}
+	return nil
+}
+
+func (assignAction) Request(alert Alert, rule Suppression, config JsonConfig) (string, any, AuditEntry) {
+	req := AssignRequest{ID: alert.InternalID, TenantID: alert.TenantID, AssigneeID: rule.Assignee}
+	entry := AuditEntry{Action: "assign", Assignee: rule.Assignee}
+	return alertURL(config, "assign", alert), req, entry
+}
+
+// commentAction is not retried: a comment whose answer was lost would be
+// posted twice.
+type commentAction struct{}
+
+func (commentAction) Retry(config JsonConfig) RetryPolicy {
+	policy := defaultRetry(config)
+	policy.Attempts = 1
+	return policy
+}
+func (commentAction) Done() string { return "Commented" }
+
+func (commentAction) Check(rule Suppression) error {
+	if rule.Comment == "" {
+		return fmt.Errorf("comment needs a comment")
+	}
+	return nil
+}
+
+func (commentAction) Request(alert Alert, rule Suppression, config JsonConfig) (string, any, AuditEntry) {
+	req := CommentRequest{ID: alert.InternalID, TenantID: alert.TenantID, Comment: rule.Comment}
+	entry := AuditEntry{Action: "comment", Comment: rule.Comment}
+	return alertURL(config, "comment", alert), req, entry
+}
+
+type incidentAction struct{}
+
+func (incidentAction) Retry(config JsonConfig) RetryPolicy { return defaultRetry(config) }
+func (incidentAction) Done() string                        { return "Linked" }
+
+func (incidentAction) Check(rule Suppression) error {
+	if rule.IncidentID == "" {
+		return fmt.Errorf("linkIncident needs an incidentID")
+	}
+	return nil
+}
+
+func (incidentAction) Request(alert Alert, rule Suppression, config JsonConfig) (string, any, AuditEntry) {
+	req := IncidentLinkRequest{ID: alert.InternalID, TenantID: alert.TenantID, IncidentID: rule.IncidentID}
+	entry := AuditEntry{Action: "linkIncident", IncidentID: rule.IncidentID}
+	return alertURL(config, "incident", alert), req, entry
+}
+
+type tagAction struct{}
+
+func (tagAction) Retry(config JsonConfig) RetryPolicy { return defaultRetry(config) }
+func (tagAction) Done() string                        { return "Tagged" }
+
+func (tagAction) Check(rule Suppression) error {
+	if len(rule.Tags) == 0 {
+		return fmt.Errorf("tag needs tags")
+	}
+	return nil
+}
+
+func (tagAction) Request(alert Alert, rule Suppression, config JsonConfig) (string, any, AuditEntry) {
+	req := TagRequest{ID: alert.InternalID, TenantID: alert.TenantID, Tags: rule.Tags}
+	entry := AuditEntry{Action: "tag", Tags: rule.Tags}
+	return alertURL(config, "tags", alert), req, entry
+}
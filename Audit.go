@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the close audit log: a single request sent for
+// an alert, close or other action, and what the server answered. Intent
+// entries are recorded before sending, so that a request whose answer was
+// never logged still leaves a trace.
+type AuditEntry struct {
+	Time           string   `json:"time"`
+	RunID          string   `json:"runID"`
+	Action         string   `json:"action"`
+	AlertID        string   `json:"alertID"`
+	AlertName      string   `json:"alertName"`
+	TenantID       string   `json:"tenantID"`
+	Suppression    string   `json:"suppression,omitempty"`
+	PreviousStatus string   `json:"previousStatus,omitempty"`
+	NewStatus      string   `json:"newStatus,omitempty"`
+	Reason         string   `json:"reason,omitempty"`
+	Comment        string   `json:"comment,omitempty"`
+	Assignee       string   `json:"assignee,omitempty"`
+	IncidentID     string   `json:"incidentID,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	Batch          int      `json:"batch,omitempty"`
+	Attempt        int      `json:"attempt"`
+	Intent         bool     `json:"intent,omitempty"`
+	Status         int      `json:"status,omitempty"`
+	Response       string   `json:"response,omitempty"`
+	Error          string   `json:"error,omitempty"`
+	Success        bool     `json:"success"`
+	PrevHash       string   `json:"prevHash,omitempty"`
+	Hash           string   `json:"hash,omitempty"`
+}
+
+// maxAuditResponse bounds the server answer kept in an entry.
+const maxAuditResponse = 1024
+
+// AuditLog appends entries to a JSON lines file, synced after each write.
+// When chained, every entry carries the hash of the previous one and its
+// own, so that editing or removing a line breaks the chain.
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	runID    string
+	chained  bool
+	lastHash string
+	err      error
+}
+
+func OpenAuditLog(path string, chained bool, runID string) (*AuditLog, error) {
+	lastHash, err := lastAuditHash(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log open error: %w", err)
+	}
+	return &AuditLog{file: file, runID: runID, chained: chained, lastHash: lastHash}, nil
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// Record completes entry with the time, run ID and chain hashes and appends
+// it to the log. After a failure the log refuses further entries, see Err.
+func (a *AuditLog) Record(entry AuditEntry) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.err != nil {
+		return a.err
+	}
+	if err := a.write(entry); err != nil {
+		a.err = err
+		return err
+	}
+	return nil
+}
+
+// Err returns the error that made the log stop recording. No request may be
+// sent once it is set, since its outcome could not be logged.
+func (a *AuditLog) Err() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+func (a *AuditLog) write(entry AuditEntry) error {
+	entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	entry.RunID = a.runID
+	if len(entry.Response) > maxAuditResponse {
+		entry.Response = strings.ToValidUTF8(entry.Response[:maxAuditResponse], "")
+	}
+	if a.chained {
+		entry.PrevHash = a.lastHash
+		hash, err := entryHash(entry)
+		if err != nil {
+			return err
+		}
+		entry.Hash = hash
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("audit marshal error: %w", err)
+	}
+	info, err := a.file.Stat()
+	if err != nil {
+		return fmt.Errorf("audit stat error: %w", err)
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		// Drop the partial line so the log stays readable.
+		a.file.Truncate(info.Size())
+		return fmt.Errorf("audit write error: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("audit sync error: %w", err)
+	}
+	a.lastHash = entry.Hash
+	return nil
+}
+
+// entryHash is the SHA-256 of the entry without its own hash.
+func entryHash(entry AuditEntry) (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("audit marshal error: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastAuditHash returns the hash of the last entry of the log at path, so a
+// new run continues the chain.
+func lastAuditHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("audit log open error: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("audit log stat error: %w", err)
+	}
+	// Entries are bounded by maxAuditResponse, the last one fits in the tail.
+	offset := max(info.Size()-64<<10, 0)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return "", fmt.Errorf("audit log read error: %w", err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(tail), []byte("\n"))
+	if len(lines) == 0 || len(lines[len(lines)-1]) == 0 {
+		return "", nil
+	}
+	var entry AuditEntry
+	if err := json.Unmarshal(lines[len(lines)-1], &entry); err != nil {
+		return "", fmt.Errorf("audit log is corrupted: %w", err)
+	}
+	return entry.Hash, nil
+}
+
+// ReadAuditLog passes every entry of the log at path to fn.
+func ReadAuditLog(path string, fn func(line int, entry AuditEntry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("audit log open error: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("audit log line %d: %w", line, err)
+		}
+		if err := fn(line, entry); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ClosedIDs returns the alerts successfully closed according to the log at
+// path and not reopened since. A missing log has none.
+func ClosedIDs(path string) (map[string]bool, error) {
+	closed := make(map[string]bool)
+	if !FileExists(path) {
+		return closed, nil
+	}
+	err := ReadAuditLog(path, func(line int, entry AuditEntry) error {
+		if !entry.Success {
+			return nil
+		}
+		switch entry.Action {
+		case "close":
+			closed[entry.AlertID] = true
+		case "reopen":
+			delete(closed, entry.AlertID)
+		}
+		return nil
+	})
+	return closed, err
+}
+
+// VerifyAuditLog checks the hash chain of the log at path and returns the
+// number of entries. Entries written before chaining was enabled are
+// accepted up to the first chained one. Removing the last entries cannot be
+// detected from the log alone.
+func VerifyAuditLog(path string) (int, error) {
+	count := 0
+	prev := ""
+	chained := false
+	err := ReadAuditLog(path, func(line int, entry AuditEntry) error {
+		count++
+		if entry.Hash == "" {
+			if chained {
+				return fmt.Errorf("line %d: entry without hash in a chained log", line)
+			}
+			return nil
+		}
+		if entry.PrevHash != prev {
+			return fmt.Errorf("line %d: chain broken, previous entry was modified or removed", line)
+		}
+		hash, err := entryHash(entry)
+		if err != nil {
+			return err
+		}
+		if hash != entry.Hash {
+			return fmt.Errorf("line %d: entry was modified", line)
+		}
+		chained = true
+		prev = entry.Hash
+		return nil
+	})
+	return count, err
+}
+
+// runAuditVerify checks the hash chain of the close audit log:
+//
+//	xdr-cleaner audit-verify [-log close-audit.log]
+func runAuditVerify(config JsonConfig, args []string) int {
+	fs := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	path := fs.String("log", config.AuditLog, "close audit log")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	count, err := VerifyAuditLog(*path)
+	if err != nil {
+		fmt.Println("AUDIT ERROR:", err)
+		return 1
+	}
+	fmt.Printf("%s: %d entries, chain intact\n", *path, count)
+	return 0
+}
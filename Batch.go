@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// BatchCloseResult is the outcome of one alert of a batch close.
+type BatchCloseResult struct {
+	ID      string `json:"ID"`
+	Success bool   `json:"Success"`
+	Error   string `json:"Error"`
+}
+
+type BatchCloseResponse struct {
+	Results []BatchCloseResult `json:"Results"`
+}
+
+// closeBatch closes alerts of a single tenant in one request. Alerts the
+// answer does not mention, or all of them when the request fails, are then
+// closed one by one.
+func closeBatch(ctx context.Context, alerts []Alert, config JsonConfig, client *http.Client, audit *AuditLog) []CloseResult {
+	reqs := make([]CloseRequest, 0, len(alerts))
+	entries := make([]AuditEntry, 0, len(alerts))
+	for _, alert := range alerts {
+		rule := alertRule(alert, config)
+		req, entry := closeRequest(alert, rule)
+		entry.Suppression = rule.Name
+		entry.AlertID = alert.InternalID
+		entry.AlertName = alert.Name
+		entry.TenantID = alert.TenantID
+		entry.Batch = len(alerts)
+		reqs = append(reqs, req)
+		entries = append(entries, entry)
+	}
+
+	jsonData, err := json.Marshal(reqs)
+	if err != nil {
+		fmt.Printf("Batch close of %d alerts failed, closing them one by one: JSON marshal error: %v\n", len(alerts), err)
+		return closeSingly(ctx, alerts, config, client, audit)
+	}
+
+	url := alertURL(config, "close/batch", alerts[0])
+	if config.Debug {
+		fmt.Printf("Sending batch close request of %d alerts: POST %s\n", len(alerts), url)
+	}
+
+	// Intents and failed attempts are recorded for every alert of the
+	// batch; the outcome of a successful one is recorded per alert below.
+	intent := func(attempt int) error {
+		for _, e := range entries {
+			e.Attempt = attempt
+			e.Intent = true
+			if err := recordAudit(audit, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	last := 0
+	record := func(attempt int, status int, body string, err error) {
+		last = attempt
+		if err == nil && status >= 200 && status < 300 {
+			return
+		}
+		for _, e := range entries {
+			e.Attempt = attempt
+			e.Status = status
+			e.Response = body
+			if err != nil {
+				e.Error = err.Error()
+			}
+			recordAudit(audit, e)
+		}
+	}
+
+	status, body, err := postWithRetry(ctx, url, jsonData, closeAction{}.Retry(config), config, client, intent, record)
+	if errors.Is(err, errNotSent) {
+		results := make([]CloseResult, 0, len(alerts))
+		for _, alert := range alerts {
+			result := skippedResult(alert)
+			result.Error = err
+			results = append(results, result)
+		}
+		return results
+	}
+	if err == nil && (status < 200 || status >= 300) {
+		err = fmt.Errorf("HTTP %d: %s", status, body)
+	}
+	var resp BatchCloseResponse
+	if err == nil {
+		if jsonErr := json.Unmarshal([]byte(body), &resp); jsonErr != nil {
+			err = fmt.Errorf("batch response JSON error: %w", jsonErr)
+			for _, e := range entries {
+				e.Attempt = last
+				e.Status = status
+				e.Response = body
+				e.Error = err.Error()
+				recordAudit(audit, e)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Printf("Batch close of %d alerts failed, closing them one by one: %v\n", len(alerts), err)
+		return closeSingly(ctx, alerts, config, client, audit)
+	}
+
+	outcomes := make(map[string]BatchCloseResult, len(resp.Results))
+	for _, r := range resp.Results {
+		outcomes[r.ID] = r
+	}
+	results := make([]CloseResult, 0, len(alerts))
+	var missing []Alert
+	for i, alert := range alerts {
+		outcome, ok := outcomes[alert.InternalID]
+		if !ok {
+			missing = append(missing, alert)
+			continue
+		}
+		e := entries[i]
+		e.Attempt = last
+		e.Status = status
+		e.Success = outcome.Success
+		e.Error = outcome.Error
+		recordAudit(audit, e)
+
+		result := CloseResult{Action: "close", AlertID: alert.InternalID, AlertName: alert.Name, TenantID: alert.TenantID, Success: outcome.Success}
+		switch {
+		case outcome.Success:
+		case alreadyClosedAnswer(outcome.Error):
+			result.AlreadyClosed = true
+		default:
+			result.Error = fmt.Errorf("batch close: %s", outcome.Error)
+		}
+		results = append(results, result)
+	}
+	if len(missing) > 0 {
+		fmt.Printf("Batch close answer lacks %d of %d alerts, closing them one by one\n", len(missing), len(alerts))
+		results = append(results, closeSingly(ctx, missing, config, client, audit)...)
+	}
+	return results
+}
+
+// closeSingly closes alerts one request each, skipping them once ctx is
+// cancelled or the audit log failed.
+func closeSingly(ctx context.Context, alerts []Alert, config JsonConfig, client *http.Client, audit *AuditLog) []CloseResult {
+	results := make([]CloseResult, 0, len(alerts))
+	for _, alert := range alerts {
+		if ctx.Err() != nil || audit.Err() != nil {
+			results = append(results, skippedResult(alert))
+			continue
+		}
+		results = append(results, applyAction(ctx, alert, config, client, audit))
+	}
+	return results
+}
+
+// recordAudit records entry and reports a failure, which stops the queue
+// from starting new requests.
+func recordAudit(audit *AuditLog, entry AuditEntry) error {
+	err := audit.Record(entry)
+	if err != nil {
+		fmt.Printf("AUDIT ERROR: %s: %v\n", entry.AlertID, err)
+	}
+	return err
+}
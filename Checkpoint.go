@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Checkpoint records which pages are durably written to the outfile so an
+// interrupted run can resume instead of starting over. It is saved next to
+// the outfile after every flush and removed once the file is finalized.
+type Checkpoint struct {
+	mu        sync.Mutex
+	path      string
+	QueryHash string `json:"queryHash"`
+	// Until and From are the bounds resolved by the run that started the
+	// checkpoint (run start, incremental lower bound per tenant), which
+	// the page keys depend on; a resumed run reuses them.
+	Until string            `json:"until,omitempty"`
+	From  map[string]string `json:"from,omitempty"`
+	FlushProgress
+	Pages map[string]CheckpointPage `json:"pages"`
+}
+
+// FlushProgress is how far a FlushManager got: the alerts flushed and the
+// size of the file being written, plus the chunks completed when the
+// output is split.
+type FlushProgress struct {
+	Flushed     int             `json:"flushed"`
+	Offset      int64           `json:"offset"`
+	Chunk       int             `json:"chunk,omitempty"`
+	ChunkAlerts int             `json:"chunkAlerts"`
+	Chunks      []ManifestChunk `json:"chunks,omitempty"`
+}
+
+type CheckpointPage struct {
+	Alerts int  `json:"alerts"`
+	Last   bool `json:"last"`
+}
+
+func CheckpointPath(outfile string) string {
+	return outfile + ".checkpoint"
+}
+
+// QueryHash identifies the query a checkpoint belongs to; a checkpoint is
+// only reused when every parameter that shapes the pages is unchanged.
+func QueryHash(config JsonConfig) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%s|%d|%t|%s|%s|%d|%d|", BuildURL(config, 0), config.FetchStrategy, config.WindowSize, config.PageSize, config.Incremental, config.OutputFormat, CompressionFor(config.Outfile, config.Compression), config.SplitEvery, config.SplitEveryMB)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LoadCheckpoint returns the checkpoint for outfile when it matches the
+// current query, or a fresh one otherwise.
+func LoadCheckpoint(outfile string, config JsonConfig) *Checkpoint {
+	cp := &Checkpoint{
+		path:      CheckpointPath(outfile),
+		QueryHash: QueryHash(config),
+		Pages:     make(map[string]CheckpointPage),
+	}
+	data, err := fileGetContentsBytes(cp.path)
+	if err != nil {
+		return cp
+	}
+	var saved Checkpoint
+	if err := json.Unmarshal(data, &saved); err != nil || saved.QueryHash != cp.QueryHash {
+		if config.Debug {
+			fmt.Printf("Ignoring stale checkpoint %s\n", cp.path)
+		}
+		return cp
+	}
+	if saved.Pages != nil {
+		cp.Pages = saved.Pages
+	}
+	cp.Until = saved.Until
+	cp.From = saved.From
+	cp.FlushProgress = saved.FlushProgress
+	return cp
+}
+
+// RunAt returns the run start recorded in the checkpoint, or records runAt
+// when there is none yet.
+func (cp *Checkpoint) RunAt(runAt time.Time) time.Time {
+	if cp == nil {
+		return runAt
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if until, err := time.Parse(time.RFC3339Nano, cp.Until); err == nil {
+		return until
+	}
+	cp.Until = runAt.UTC().Format(time.RFC3339Nano)
+	return runAt
+}
+
+// FromDate returns the lower bound recorded in the checkpoint for tenant,
+// or records from when there is none yet.
+func (cp *Checkpoint) FromDate(tenant string, from string) string {
+	if cp == nil {
+		return from
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if saved, ok := cp.From[tenant]; ok {
+		return saved
+	}
+	if cp.From == nil {
+		cp.From = make(map[string]string)
+	}
+	cp.From[tenant] = from
+	return from
+}
+
+// Resumable reports whether the checkpoint holds flushed pages to resume.
+func (cp *Checkpoint) Resumable() bool {
+	if cp == nil {
+		return false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return len(cp.Pages) > 0 && (cp.Offset > 0 || len(cp.Chunks) > 0)
+}
+
+func (cp *Checkpoint) Page(key string) (CheckpointPage, bool) {
+	if cp == nil {
+		return CheckpointPage{}, false
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	page, ok := cp.Pages[key]
+	return page, ok
+}
+
+// Commit records pages whose alerts are now on disk as of progress.
+func (cp *Checkpoint) Commit(pages map[string]CheckpointPage, progress FlushProgress) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	for key, page := range pages {
+		cp.Pages[key] = page
+	}
+	cp.FlushProgress = progress
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("checkpoint marshal error: %w", err)
+	}
+	if err := FilePutContentsAtomic(cp.path, data); err != nil {
+		return fmt.Errorf("checkpoint write error: %w", err)
+	}
+	return nil
+}
+
+func (cp *Checkpoint) Remove() error {
+	err := os.Remove(cp.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func pageKey(config JsonConfig, page int) string {
+	return fmt.Sprintf("%s|%s|%s|%d", config.TenantID, config.FromDate, config.ToDate, page)
+}
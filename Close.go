@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,132 +19,407 @@ type CloseRequest struct {
 	ID       string `json:"ID"`
 	TenantID string `json:"TenantID"`
 	Reason   string `json:"Reason"`
+	Comment  string `json:"Comment,omitempty"`
 }
 
 type CloseResult struct {
+	Action    string
 	AlertID   string
 	AlertName string
+	TenantID  string
 	Success   bool
-	Error     error
+	Skipped   bool
+	// AlreadyClosed is set when the server answered the alert was closed.
+	AlreadyClosed bool
+	Error         error
 }
 
-func CloseAlerts(alerts []Alert, config JsonConfig, client *http.Client) {
-	if !config.CloseAlerts {
-		fmt.Println("CloseAlerts is disabled in config")
-		return
-	}
+// CloseSummary lists the outcome of every alert handed to CloseAlerts, so an
+// interrupted run leaves a record of what was and was not closed.
+type CloseSummary struct {
+	Metadata      *RunMetadata `json:"metadata,omitempty"`
+	Result        *RunResult   `json:"result,omitempty"`
+	Interrupted   bool         `json:"interrupted"`
+	AuditError    string       `json:"auditError,omitempty"`
+	Closed        []CloseEntry `json:"closed"`
+	Failed        []CloseEntry `json:"failed"`
+	NotAttempted  []CloseEntry `json:"notAttempted"`
+	Refused       []CloseEntry `json:"refused,omitempty"`
+	AlreadyClosed []CloseEntry `json:"alreadyClosed,omitempty"`
+}
 
-	if len(alerts) == 0 {
-		fmt.Println("No alerts to close")
-		return
-	}
+type CloseEntry struct {
+	Action   string `json:"Action,omitempty"`
+	ID       string `json:"ID"`
+	Name     string `json:"Name"`
+	TenantID string `json:"TenantID"`
+	Error    string `json:"Error,omitempty"`
+}
 
-	fmt.Printf("Starting to close %d alerts...\n", len(alerts))
+// CloseQueue applies the action of each alert (closing it, by default) as
+// alerts are added, with at most closeConcurrency requests in flight. Add blocks once
+// queueSize alerts are waiting, which slows the producer down instead of
+// buffering without bound. Once ctx is cancelled, or the audit log failed,
+// no new close is started; closes already sent are allowed to complete so
+// that their outcome is known.
+type CloseQueue struct {
+	ctx     context.Context
+	audit   *AuditLog
+	config  JsonConfig
+	title   string
+	done    string
+	input   chan Alert
+	queue   chan []Alert
+	results chan CloseResult
+	wg      sync.WaitGroup
+	stopped chan struct{}
+	summary CloseSummary
+	applied map[string]int
+}
 
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 10)
-	results := make(chan CloseResult, len(alerts))
+func StartCloseQueue(ctx context.Context, config JsonConfig, client *http.Client, audit *AuditLog) *CloseQueue {
+	var batch func([]Alert) []CloseResult
+	if config.CloseBatchSize > 1 {
+		batch = func(alerts []Alert) []CloseResult {
+			return closeBatch(ctx, alerts, config, client, audit)
+		}
+	}
+	return startQueue(ctx, config, audit, "Close", "Closed", func(alert Alert) CloseResult {
+		return applyAction(ctx, alert, config, client, audit)
+	}, batch)
+}
 
-	for _, alert := range alerts {
-		wg.Add(1)
-		go func(a Alert) {
-			defer wg.Done()
-			semaphore <- struct{}{}
-			defer func() { <-semaphore }()
+// startQueue runs do on the queued alerts; title and done name the action
+// in the messages ("Close", "Closed"). When batch is set, the closes of a
+// tenant are grouped by closeBatchSize and handed to batch instead.
+func startQueue(ctx context.Context, config JsonConfig, audit *AuditLog, title string, done string, do func(Alert) CloseResult, batch func([]Alert) []CloseResult) *CloseQueue {
+	q := &CloseQueue{
+		ctx:     ctx,
+		audit:   audit,
+		config:  config,
+		title:   title,
+		done:    done,
+		input:   make(chan Alert, config.CloseQueueSize),
+		queue:   make(chan []Alert),
+		results: make(chan CloseResult, config.CloseQueueSize),
+		stopped: make(chan struct{}),
+		applied: make(map[string]int),
+	}
+
+	size := 1
+	if batch != nil {
+		size = config.CloseBatchSize
+	}
+	go q.group(size)
 
-			result := closeAlert(a, config, client)
-			results <- result
-		}(alert)
+	for i := 0; i < max(config.CloseConcurrency, 1); i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for alerts := range q.queue {
+				switch {
+				case ctx.Err() != nil || audit.Err() != nil:
+					for _, alert := range alerts {
+						q.results <- skippedResult(alert)
+					}
+				case len(alerts) == 1:
+					q.results <- do(alerts[0])
+				default:
+					for _, result := range batch(alerts) {
+						q.results <- result
+					}
+				}
+			}
+		}()
 	}
 
 	go func() {
-		wg.Wait()
-		close(results)
+		defer close(q.stopped)
+		for result := range q.results {
+			q.record(result)
+		}
 	}()
 
-	successCount := 0
-	failCount := 0
+	return q
+}
 
-	for result := range results {
-		if result.Success {
-			successCount++
-			if config.Debug {
-				fmt.Printf("✓ Closed: %s (%s)\n", result.AlertID, result.AlertName)
-			}
-		} else {
-			failCount++
-			fmt.Printf("✗ Failed to close %s (%s): %v\n", result.AlertID, result.AlertName, result.Error)
+// group hands the added alerts to the workers, gathering the closes of each
+// tenant in batches of size. Incomplete batches are sent once no more
+// alerts can be added.
+func (q *CloseQueue) group(size int) {
+	defer close(q.queue)
+	pending := make(map[string][]Alert)
+	for alert := range q.input {
+		if size <= 1 || alertRule(alert, q.config).Action != "close" {
+			q.queue <- []Alert{alert}
+			continue
+		}
+		batch := append(pending[alert.TenantID], alert)
+		if len(batch) < size {
+			pending[alert.TenantID] = batch
+			continue
 		}
+		delete(pending, alert.TenantID)
+		q.queue <- batch
+	}
+	for _, tenant := range slices.Sorted(maps.Keys(pending)) {
+		q.queue <- pending[tenant]
 	}
+}
 
-	fmt.Printf("\nClose Summary:\n")
-	fmt.Printf("  Success: %d\n", successCount)
-	fmt.Printf("  Failed:  %d\n", failCount)
-	fmt.Printf("  Total:   %d\n", len(alerts))
+func (q *CloseQueue) Add(alert Alert) {
+	if q.ctx.Err() == nil {
+		select {
+		case q.input <- alert:
+			return
+		case <-q.ctx.Done():
+		}
+	}
+	q.results <- skippedResult(alert)
 }
 
-func closeAlert(alert Alert, config JsonConfig, client *http.Client) CloseResult {
+func (q *CloseQueue) record(result CloseResult) {
+	entry := CloseEntry{ID: result.AlertID, Name: result.AlertName, TenantID: result.TenantID}
+	done, title := q.done, q.title
+	if action, ok := alertActions[result.Action]; ok && result.Action != "close" {
+		entry.Action = result.Action
+		done, title = action.Done(), result.Action
+	}
+	switch {
+	case result.Skipped:
+		q.summary.NotAttempted = append(q.summary.NotAttempted, entry)
+	case result.AlreadyClosed:
+		q.summary.AlreadyClosed = append(q.summary.AlreadyClosed, entry)
+		if q.config.Debug {
+			fmt.Printf("✓ Already closed: %s (%s)\n", result.AlertID, result.AlertName)
+		}
+	case result.Success:
+		q.summary.Closed = append(q.summary.Closed, entry)
+		if result.Action != "" {
+			q.applied[result.Action]++
+		}
+		if q.config.Debug {
+			fmt.Printf("✓ %s: %s (%s)\n", done, result.AlertID, result.AlertName)
+		}
+	default:
+		entry.Error = result.Error.Error()
+		q.summary.Failed = append(q.summary.Failed, entry)
+		fmt.Printf("✗ Failed to %s %s (%s): %v\n", strings.ToLower(title), result.AlertID, result.AlertName, result.Error)
+	}
+}
+
+// Wait stops accepting alerts, waits for the queued closes and prints the
+// summary.
+func (q *CloseQueue) Wait() CloseSummary {
+	close(q.input)
+	q.wg.Wait()
+	close(q.results)
+	<-q.stopped
+
+	summary := q.summary
+	summary.Interrupted = q.ctx.Err() != nil
+	if err := q.audit.Err(); err != nil {
+		summary.AuditError = err.Error()
+	}
+
+	fmt.Printf("\n%s Summary:\n", q.title)
+	fmt.Printf("  Success: %d\n", len(summary.Closed))
+	if len(q.applied) > 1 || q.applied["close"] == 0 {
+		for _, action := range slices.Sorted(maps.Keys(q.applied)) {
+			fmt.Printf("    %s: %d\n", action, q.applied[action])
+		}
+	}
+	if len(summary.AlreadyClosed) > 0 {
+		fmt.Printf("  Already closed: %d\n", len(summary.AlreadyClosed))
+	}
+	fmt.Printf("  Failed:  %d\n", len(summary.Failed))
+	switch {
+	case summary.AuditError != "":
+		fmt.Printf("  Not attempted (audit log error): %d\n", len(summary.NotAttempted))
+	case summary.Interrupted:
+		fmt.Printf("  Not attempted (interrupted): %d\n", len(summary.NotAttempted))
+	}
+	fmt.Printf("  Total:   %d\n", len(summary.Closed)+len(summary.AlreadyClosed)+len(summary.Failed)+len(summary.NotAttempted))
+	return summary
+}
+
+func skippedResult(alert Alert) CloseResult {
+	return CloseResult{AlertID: alert.InternalID, AlertName: alert.Name, TenantID: alert.TenantID, Skipped: true}
+}
+
+// alreadyClosed reports whether alert is closed according to its status.
+func alreadyClosed(alert Alert) bool {
+	if strings.EqualFold(alert.Status, "closed") {
+		return true
+	}
+	return alert.Status == "" && alert.StatusResolution != ""
+}
+
+// alreadyClosedAnswer reports whether a refused close was refused because
+// the alert is closed already, as its error message says. A 409 Conflict
+// alone is not enough: it also answers concurrent edits or locks.
+func alreadyClosedAnswer(body string) bool {
+	body = strings.ToLower(body)
+	return strings.Contains(body, "already closed") || strings.Contains(body, "already been closed")
+}
+
+func failedResult(alert Alert, err error) CloseResult {
+	return CloseResult{AlertID: alert.InternalID, AlertName: alert.Name, TenantID: alert.TenantID, Error: err}
+}
+
+// CloseAlerts closes a list of alerts through a CloseQueue.
+func CloseAlerts(ctx context.Context, alerts []Alert, config JsonConfig, client *http.Client, audit *AuditLog) CloseSummary {
+	if !config.CloseAlerts {
+		fmt.Println("CloseAlerts is disabled in config")
+		return CloseSummary{}
+	}
+
+	if len(alerts) == 0 {
+		fmt.Println("No alerts to close")
+		return CloseSummary{}
+	}
+
+	fmt.Printf("Starting to close %d alerts...\n", len(alerts))
+
+	q := StartCloseQueue(ctx, config, client, audit)
+	for _, alert := range alerts {
+		q.Add(alert)
+	}
+	return q.Wait()
+}
+
+func SaveCloseSummary(summary CloseSummary, filename string) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %w", err)
+	}
+	if err := FilePutContentsAtomic(filename, data); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	fmt.Printf("Close summary written to %s\n", filename)
+	return nil
+}
+
+// postAlertRequest posts payload to url on behalf of alert, retrying server
+// errors as policy allows, and records every attempt in audit as a copy of
+// entry, before sending and once answered. An alert whose first intent
+// cannot be recorded is not attempted.
+func postAlertRequest(ctx context.Context, alert Alert, url string, payload any, entry AuditEntry, policy RetryPolicy, config JsonConfig, client *http.Client, audit *AuditLog) CloseResult {
 	result := CloseResult{
 		AlertID:   alert.InternalID,
 		AlertName: alert.Name,
+		TenantID:  alert.TenantID,
 	}
 
-	closeReq := CloseRequest{
-		ID:       alert.InternalID,
-		TenantID: alert.TenantID,
-		Reason:   config.CloseReason,
-	}
-
-	jsonData, err := json.Marshal(closeReq)
+	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		result.Error = fmt.Errorf("JSON marshal error: %w", err)
 		return result
 	}
 
-	url := fmt.Sprintf("%s/alerts/close?tenantID=%s", config.BaseURL, alert.TenantID)
-
 	if config.Debug {
-		fmt.Printf("Closing alert: POST %s\n", url)
+		fmt.Printf("Sending %s request: POST %s\n", entry.Action, url)
 		fmt.Printf("Body: %s\n", string(jsonData))
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		result.Error = fmt.Errorf("request creation error: %w", err)
-		return result
+	entry.AlertID = alert.InternalID
+	entry.AlertName = alert.Name
+	entry.TenantID = alert.TenantID
+	intent := func(attempt int) error {
+		e := entry
+		e.Attempt = attempt
+		e.Intent = true
+		return recordAudit(audit, e)
+	}
+	record := func(attempt int, status int, body string, err error) {
+		e := entry
+		e.Attempt = attempt
+		e.Status = status
+		e.Response = body
+		e.Success = err == nil && status >= 200 && status < 300
+		if err != nil {
+			e.Error = err.Error()
+		}
+		recordAudit(audit, e)
+	}
+
+	status, body, err := postWithRetry(ctx, url, jsonData, policy, config, client, intent, record)
+	switch {
+	case errors.Is(err, errNotSent):
+		result.Skipped = true
+		result.Error = err
+	case err != nil:
+		result.Error = err
+	case status >= 200 && status < 300:
+		result.Success = true
+	case entry.Action == "close" && alreadyClosedAnswer(body):
+		result.AlreadyClosed = true
+	default:
+		result.Error = fmt.Errorf("HTTP %d: %s", status, body)
 	}
+	return result
+}
 
-	req.Header.Set("Authorization", "Bearer "+config.Token)
-	req.Header.Set("Content-Type", "application/json")
+// errNotSent marks a request given up before sending it, because its
+// intent could not be recorded in the audit log.
+var errNotSent = errors.New("not sent")
 
-	maxRetries := 3
+// postWithRetry posts jsonData to url, retrying network errors and
+// retryable answers as policy allows. Each attempt is passed to intent
+// before it is sent, and to record once answered; an intent error stops the
+// attempts. It returns the last answer, or an error when none was received.
+func postWithRetry(ctx context.Context, url string, jsonData []byte, policy RetryPolicy, config JsonConfig, client *http.Client, intent func(attempt int) error, record func(attempt int, status int, body string, err error)) (int, string, error) {
+	maxRetries := max(policy.Attempts, 1)
+	var lastStatus int
+	var lastBody string
+	var lastErr error
 	for attempt := 1; attempt <= maxRetries; attempt++ {
+		if err := intent(attempt); err != nil {
+			if attempt == 1 {
+				return 0, "", fmt.Errorf("%w: %v", errNotSent, err)
+			}
+			return lastStatus, lastBody, lastErr
+		}
+
+		// A new request per attempt: the body of the previous one has been
+		// read. The request itself is not cancelled with ctx: once sent,
+		// its outcome must be known. Only further retries are abandoned.
+		req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), "POST", url, bytes.NewReader(jsonData))
+		if err != nil {
+			return 0, "", fmt.Errorf("request creation error: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+config.Token)
+		req.Header.Set("Content-Type", "application/json")
+
 		resp, err := client.Do(req)
 		if err != nil {
-			if attempt < maxRetries {
-				time.Sleep(time.Second * time.Duration(attempt))
+			record(attempt, 0, "", err)
+			lastStatus, lastBody, lastErr = 0, "", fmt.Errorf("HTTP error after %d attempts: %w", attempt, err)
+			if attempt < maxRetries && sleepCtx(ctx, policy.wait(attempt)) {
 				continue
 			}
-			result.Error = fmt.Errorf("HTTP error after %d attempts: %w", maxRetries, err)
-			return result
+			return lastStatus, lastBody, lastErr
 		}
 
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close()
+		record(attempt, resp.StatusCode, string(body), nil)
+		lastStatus, lastBody, lastErr = resp.StatusCode, string(body), nil
 
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			result.Success = true
-			return result
-		}
-
-		if attempt < maxRetries && resp.StatusCode >= 500 {
-			time.Sleep(time.Second * time.Duration(attempt))
+		if resp.StatusCode >= 300 && policy.retryable(resp.StatusCode) && attempt < maxRetries && sleepCtx(ctx, policy.wait(attempt)) {
 			continue
 		}
-
-		result.Error = fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
-		return result
+		return lastStatus, lastBody, lastErr
 	}
+	return 0, "", nil
+}
 
-	return result
+// sleepCtx waits for d and reports false if ctx was cancelled meanwhile.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionFor returns the compression to use for filename: option when
+// set ("gzip", "zstd" or "none"), otherwise guessed from the extension.
+func CompressionFor(filename string, option string) string {
+	switch strings.ToLower(option) {
+	case "gzip", "gz":
+		return "gzip"
+	case "zstd", "zst":
+		return "zstd"
+	case "none":
+		return ""
+	}
+	lower := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(lower, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(lower, ".zst"), strings.HasSuffix(lower, ".zstd"):
+		return "zstd"
+	}
+	return ""
+}
+
+// CheckCompression rejects a compression option CompressionFor would ignore.
+func CheckCompression(config JsonConfig) error {
+	switch strings.ToLower(config.Compression) {
+	case "", "gzip", "gz", "zstd", "zst", "none":
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", config.Compression)
+}
+
+// newCompressor wraps w so that everything written until Close forms one
+// gzip member or zstd frame. Both formats allow members to be concatenated,
+// which lets FlushManager append a new one on every flush.
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	case "":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown compression: %s", compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressed returns a reader over the plain content of r, recognising
+// gzip and zstd streams by their magic bytes.
+func decompressed(r *bufio.Reader) (*bufio.Reader, func(), error) {
+	head, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("gzip error: %w", err)
+		}
+		return bufio.NewReader(gz), func() { gz.Close() }, nil
+	case bytes.HasPrefix(head, zstdMagic):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("zstd error: %w", err)
+		}
+		return bufio.NewReader(zr), zr.Close, nil
+	}
+	return r, func() {}, nil
+}
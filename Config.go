@@ -2,33 +2,72 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
 type JsonConfig struct {
-	PageNumber         int               `json:"pageNumber"`
-	Ids                string            `json:"ids"`
-	TenantID           string            `json:"tenantID"`
-	Token              string            `json:"token"`
-	FromDate           string            `json:"fromDate"`
-	ToDate             string            `json:"toDate"`
-	Status             string            `json:"status"`
-	WithEvents         string            `json:"withEvents"`
-	WithAffected       string            `json:"withAffected"`
-	WithHistory        string            `json:"withHistory"`
-	Outfile            string            `json:"outfile"`
-	BaseURL            string            `json:"baseURL"`
-	Debug              bool              `json:"debug"`
-	MaxConcurrentPages int               `json:"maxConcurrentPages"`
-	FilterMode         bool              `json:"filterMode"`
-	FilteredOutfile    string            `json:"filteredOutfile"`
-	Filters            []Filter          `json:"filters"`
-	CloseAlerts        bool              `json:"closeAlerts"`
-	CloseReason        string            `json:"closeReason"`
-	FlushEvery         int               `json:"flushEvery"`
-	QueryFilters       map[string]string `json:"queryFilters"`
+	PageNumber           int                `json:"pageNumber"`
+	Ids                  string             `json:"ids"`
+	TenantID             string             `json:"tenantID"`
+	Token                string             `json:"token"`
+	FromDate             string             `json:"fromDate"`
+	ToDate               string             `json:"toDate"`
+	Status               string             `json:"status"`
+	WithEvents           string             `json:"withEvents"`
+	WithAffected         string             `json:"withAffected"`
+	WithHistory          string             `json:"withHistory"`
+	Outfile              string             `json:"outfile"`
+	BaseURL              string             `json:"baseURL"`
+	Debug                bool               `json:"debug"`
+	MaxConcurrentPages   int                `json:"maxConcurrentPages"`
+	FilterMode           bool               `json:"filterMode"`
+	FilteredOutfile      string             `json:"filteredOutfile"`
+	Filters              []Filter           `json:"filters"`
+	CloseAlerts          bool               `json:"closeAlerts"`
+	CloseReason          string             `json:"closeReason"`
+	FlushEvery           int                `json:"flushEvery"`
+	QueryFilters         map[string]string  `json:"queryFilters"`
+	RequestsPerSecond    float64            `json:"requestsPerSecond"`
+	RateLimits           map[string]float64 `json:"rateLimits"`
+	AdaptiveConcurrency  bool               `json:"adaptiveConcurrency"`
+	PageRetries          int                `json:"pageRetries"`
+	PageSize             int                `json:"pageSize"`
+	FetchStrategy        string             `json:"fetchStrategy"`
+	WindowSize           string             `json:"windowSize"`
+	MaxConcurrentWindows int                `json:"maxConcurrentWindows"`
+	TimestampField       string             `json:"timestampField"`
+	Incremental          bool               `json:"incremental"`
+	StateFile            string             `json:"stateFile"`
+	Checkpoint           bool               `json:"checkpoint"`
+	Daemon               bool               `json:"daemon"`
+	PollInterval         string             `json:"pollInterval"`
+	CloseSummaryFile     string             `json:"closeSummaryFile"`
+	StreamClose          bool               `json:"streamClose"`
+	CloseQueueSize       int                `json:"closeQueueSize"`
+	OutputFormat         string             `json:"outputFormat"`
+	Compression          string             `json:"compression"`
+	ExportColumns        []string           `json:"exportColumns"`
+	SplitEvery           int                `json:"splitEvery"`
+	SplitEveryMB         int                `json:"splitEveryMB"`
+	StoreFile            string             `json:"storeFile"`
+	AuditLog             string             `json:"auditLog"`
+	AuditHashChain       bool               `json:"auditHashChain"`
+	MaxCloseCount        int                `json:"maxCloseCount"`
+	MaxClosePercent      float64            `json:"maxClosePercent"`
+	MaxCloseSeverity     string             `json:"maxCloseSeverity"`
+	AllowCloseCII        bool               `json:"allowCloseCII"`
+	SkipCloseConfirm     bool               `json:"skipCloseConfirm"`
+	Suppressions         []Suppression      `json:"suppressions"`
+	CloseComment         string             `json:"closeComment"`
+	CloseBatchSize       int                `json:"closeBatchSize"`
+	CloseConcurrency     int                `json:"closeConcurrency"`
+	CloseAttempts        int                `json:"closeAttempts"`
+	CloseBackoff         string             `json:"closeBackoff"`
+	CloseBackoffMax      string             `json:"closeBackoffMax"`
+	CloseRetryStatus     []int              `json:"closeRetryStatus"`
 }
 
 type Filter struct {
@@ -36,6 +75,35 @@ type Filter struct {
 	Value string `json:"value"`
 }
 
+// Suppression is a named set of filters, all of which must match, and the
+// action applied to the alerts it selects with its parameters.
+type Suppression struct {
+	Name       string   `json:"name"`
+	Filters    []Filter `json:"filters"`
+	Action     string   `json:"action"`
+	Reason     string   `json:"reason"`
+	Comment    string   `json:"comment"`
+	Assignee   string   `json:"assignee,omitempty"`
+	IncidentID string   `json:"incidentID,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// SuppressionRules returns the suppressions followed by the top-level
+// filters, which close with closeReason and closeComment.
+func SuppressionRules(config JsonConfig) []Suppression {
+	rules := config.Suppressions
+	if len(config.Filters) > 0 {
+		rules = append(rules[:len(rules):len(rules)], Suppression{
+			Name:    "filters",
+			Filters: config.Filters,
+			Action:  "close",
+			Reason:  config.CloseReason,
+			Comment: config.CloseComment,
+		})
+	}
+	return rules
+}
+
 func ConfigPath() string {
 	exePath, _ := os.Executable()
 	CurDir := DirName(exePath)
@@ -66,9 +134,68 @@ func LoadConfig() JsonConfig {
 	if len(config.CloseReason) == 0 {
 		config.CloseReason = "falsePositive"
 	}
+	for i := range config.Suppressions {
+		if len(config.Suppressions[i].Name) == 0 {
+			config.Suppressions[i].Name = fmt.Sprintf("suppression %d", i+1)
+		}
+		if len(config.Suppressions[i].Action) == 0 {
+			config.Suppressions[i].Action = "close"
+		}
+		if len(config.Suppressions[i].Reason) == 0 {
+			config.Suppressions[i].Reason = config.CloseReason
+		}
+		if len(config.Suppressions[i].Comment) == 0 {
+			config.Suppressions[i].Comment = config.CloseComment
+		}
+	}
+	if len(config.CloseSummaryFile) == 0 {
+		config.CloseSummaryFile = DirName(ConfPath) + "/close-summary.json"
+	}
+	if len(config.AuditLog) == 0 {
+		config.AuditLog = DirName(ConfPath) + "/close-audit.log"
+	}
+	if len(config.MaxCloseSeverity) == 0 {
+		config.MaxCloseSeverity = "high"
+	}
+	if config.CloseConcurrency == 0 {
+		config.CloseConcurrency = 10
+	}
+	if config.CloseAttempts == 0 {
+		config.CloseAttempts = 3
+	}
+	if len(config.CloseBackoff) == 0 {
+		config.CloseBackoff = "1s"
+	}
+	if len(config.CloseBackoffMax) == 0 {
+		config.CloseBackoffMax = "30s"
+	}
+	if config.CloseQueueSize == 0 {
+		config.CloseQueueSize = 1000
+	}
+	if len(config.OutputFormat) == 0 {
+		config.OutputFormat = "json"
+	}
 	if config.FlushEvery == 0 {
 		config.FlushEvery = 1000
 	}
+	if config.PageRetries == 0 {
+		config.PageRetries = 3
+	}
+	if len(config.FetchStrategy) == 0 {
+		config.FetchStrategy = "pages"
+	}
+	if len(config.WindowSize) == 0 {
+		config.WindowSize = "1h"
+	}
+	if config.MaxConcurrentWindows == 0 {
+		config.MaxConcurrentWindows = 4
+	}
+	if len(config.PollInterval) == 0 {
+		config.PollInterval = "5m"
+	}
+	if len(config.StateFile) == 0 {
+		config.StateFile = DirName(ConfPath) + "/state.json"
+	}
 	if !FileExists(ConfPath) {
 		sbytes, _ := json.MarshalIndent(config, "", "\t")
 		_ = FilePutContentsBytes(ConfPath, sbytes)
@@ -112,3 +239,38 @@ func IsLink(path string) bool {
 func FilePutContentsBytes(filename string, data []byte) error {
 	return os.WriteFile(filename, data, 0644)
 }
+
+// FilePutContentsAtomic writes data to a temporary file in the same
+// directory and renames it over filename, so that a crash never leaves a
+// truncated file in place of the previous one.
+func FilePutContentsAtomic(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	if err := FilePutContentsBytes(tmp, data); err != nil {
+		return err
+	}
+	return renameSynced(tmp, filename)
+}
+
+// renameSynced renames tmp over filename once tmp is on disk, then syncs
+// the directory so that the rename itself survives a crash.
+func renameSynced(tmp, filename string) error {
+	if err := syncPath(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	return syncPath(filepath.Dir(filename))
+}
+
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync %s: %w", path, err)
+	}
+	return f.Close()
+}
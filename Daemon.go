@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// interruptContext is cancelled on the first SIGINT or SIGTERM so that
+// running work can wind down; a second signal exits immediately.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigs:
+			fmt.Printf("\nReceived %s, finishing in-flight work (send again to force exit)\n", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case <-sigs:
+			fmt.Println("Forced exit")
+			os.Exit(130)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			signal.Stop(sigs)
+			close(done)
+			cancel()
+		})
+	}
+}
+
+// runDaemon repeats runOnce every PollInterval until ctx is cancelled.
+// Cycles are always incremental so each poll only sees new or changed
+// alerts. An interrupted cycle stops fetching and drains its in-flight
+// closes before the daemon exits; its output stays in the temporary file
+// and the previous out.log is left unchanged.
+func runDaemon(ctx context.Context, config JsonConfig, client *http.Client) int {
+	config.Incremental = true
+
+	interval, err := time.ParseDuration(config.PollInterval)
+	if err != nil || interval <= 0 {
+		fmt.Println("ERROR: invalid pollInterval:", config.PollInterval)
+		return 1
+	}
+
+	fmt.Printf("Daemon mode: polling every %s\n", interval)
+	for cycle := 1; ; cycle++ {
+		start := time.Now()
+		fmt.Printf("\n=== Cycle %d started at %s ===\n", cycle, start.Format(time.RFC3339))
+
+		code := runOnce(ctx, config, client)
+		if code != 0 {
+			fmt.Printf("Cycle %d failed with code %d, retrying at next poll\n", cycle, code)
+		} else if config.Debug {
+			fmt.Printf("Cycle %d completed in %s\n", cycle, time.Since(start).Round(time.Millisecond))
+		}
+
+		select {
+		case <-ctx.Done():
+			fmt.Println("Daemon stopped")
+			return 0
+		case <-time.After(interval):
+		}
+	}
+}
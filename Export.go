@@ -0,0 +1,316 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var defaultExportColumns = []string{
+	"Alert|InternalID",
+	"Alert|Name",
+	"Alert|Severity",
+	"Alert|Status",
+	"Alert|CreatedAt",
+	"Alert|TenantID",
+	"Observable|Value|first",
+	"Rule|Name",
+	"BaseEvent|SourceAddress",
+	"BaseEvent|DestinationAddress",
+}
+
+// runExport converts an alert dump (out.log, filtered.json, NDJSON,
+// compressed or the manifest of a split output) to CSV or XLSX:
+//
+//	xdr-cleaner export -in filtered.json -out alerts.xlsx
+func runExport(config JsonConfig, args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	defaultIn := config.FilteredOutfile
+	if config.SplitEvery > 0 || config.SplitEveryMB > 0 {
+		defaultIn = ManifestPath(config.FilteredOutfile)
+	}
+	in := fs.String("in", defaultIn, "alert dump to read")
+	out := fs.String("out", "", "CSV or XLSX file to write")
+	format := fs.String("format", "", "csv or xlsx (default: from the -out extension)")
+	columns := fs.String("columns", "", "comma separated columns (default: exportColumns from config)")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *out == "" {
+		fmt.Println("ERROR: -out is required")
+		return 1
+	}
+
+	cols := config.ExportColumns
+	if *columns != "" {
+		cols = strings.Split(*columns, ",")
+	}
+	if len(cols) == 0 {
+		cols = defaultExportColumns
+	}
+	for i := range cols {
+		cols[i] = strings.TrimSpace(cols[i])
+	}
+
+	if *format == "" {
+		*format = "csv"
+		if strings.HasSuffix(strings.ToLower(*out), ".xlsx") {
+			*format = "xlsx"
+		}
+	}
+
+	count, err := ExportAlerts(*in, *out, *format, cols)
+	if err != nil {
+		fmt.Println("EXPORT ERROR:", err)
+		return 1
+	}
+	fmt.Printf("Exported %d alerts from %s to %s\n", count, *in, *out)
+	return 0
+}
+
+// ExportAlerts streams the alerts of in into a CSV or XLSX file, written
+// under a temporary name and renamed to out once complete.
+func ExportAlerts(in string, out string, format string, columns []string) (int, error) {
+	file, err := os.Create(tempName(out))
+	if err != nil {
+		return 0, fmt.Errorf("create file error: %w", err)
+	}
+	defer file.Close()
+
+	var w rowWriter
+	switch format {
+	case "csv":
+		w = newCSVWriter(file)
+	case "xlsx":
+		w, err = newXLSXWriter(file)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format: %s", format)
+	}
+
+	if err := w.WriteRow(columns); err != nil {
+		return 0, err
+	}
+	count := 0
+	err = StreamAlertsFile(in, func(alert Alert) error {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i] = ColumnValue(alert, column)
+		}
+		count++
+		return w.WriteRow(row)
+	})
+	if err != nil {
+		return count, err
+	}
+	if err := w.Close(); err != nil {
+		return count, err
+	}
+	if err := file.Close(); err != nil {
+		return count, fmt.Errorf("close error: %w", err)
+	}
+	return count, renameTemp(out)
+}
+
+// ColumnValue flattens an alert field using the filter syntax
+// "Section|Field". Nested sections yield their distinct values joined with
+// "; ", or only the first one with a "|first" suffix.
+func ColumnValue(alert Alert, column string) string {
+	parts := strings.Split(column, "|")
+	if len(parts) < 2 {
+		return ""
+	}
+	section := strings.TrimSpace(parts[0])
+	field := strings.TrimSpace(parts[1])
+	first := len(parts) > 2 && strings.TrimSpace(parts[2]) == "first"
+
+	var values []string
+	seen := make(map[string]bool)
+	add := func(value string, ok bool) {
+		if ok && value != "" && !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+
+	switch section {
+	case "Alert":
+		value, _ := exportAlertField(alert, field)
+		return value
+	case "Observable":
+		for _, obs := range alert.Observables {
+			add(observableField(obs, field))
+		}
+	case "Rule":
+		for _, rule := range alert.Rules {
+			add(ruleField(rule, field))
+		}
+	case "BaseEvent":
+		for _, event := range alert.OriginalEvents {
+			for _, baseEvent := range event.BaseEvents {
+				add(baseEventField(baseEvent, field))
+			}
+		}
+	}
+
+	if len(values) == 0 {
+		return ""
+	}
+	if first {
+		return values[0]
+	}
+	return strings.Join(values, "; ")
+}
+
+// exportAlertField also exports the alert fields filters do not match on.
+func exportAlertField(alert Alert, field string) (string, bool) {
+	switch strings.ToLower(field) {
+	case "id":
+		return fmt.Sprintf("%d", alert.ID), true
+	case "tenantid":
+		return alert.TenantID, true
+	case "statusresolution":
+		return alert.StatusResolution, true
+	case "createdat":
+		return alert.CreatedAt, true
+	case "updatedat":
+		return alert.UpdatedAt, true
+	case "firsteventtime":
+		return alert.FirstEventTime, true
+	case "lasteventtime":
+		return alert.LastEventTime, true
+	case "assignee":
+		return alert.Assignee.Name, true
+	case "iscii":
+		return fmt.Sprintf("%t", alert.IsCII), true
+	}
+	return alertField(alert, field)
+}
+
+type rowWriter interface {
+	WriteRow(row []string) error
+	Close() error
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(out io.Writer) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(out)}
+}
+
+// WriteRow prefixes with a quote the cells a spreadsheet would read as a
+// formula, since alert fields come from untrusted events.
+func (c *csvWriter) WriteRow(row []string) error {
+	escaped := make([]string, len(row))
+	for i, cell := range row {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			cell = "'" + cell
+		}
+		escaped[i] = cell
+	}
+	return c.w.Write(escaped)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// xlsxWriter writes a single-sheet workbook with inline strings, streaming
+// rows straight into the zip entry of the sheet.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+func newXLSXWriter(out io.Writer) (*xlsxWriter, error) {
+	zw := zip.NewWriter(out)
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Alerts" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+	}
+	for _, part := range parts {
+		w, err := zw.Create(part.name)
+		if err != nil {
+			return nil, fmt.Errorf("xlsx error: %w", err)
+		}
+		if _, err := io.WriteString(w, part.content); err != nil {
+			return nil, fmt.Errorf("xlsx error: %w", err)
+		}
+	}
+
+	w, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, fmt.Errorf("xlsx error: %w", err)
+	}
+	sheet := bufio.NewWriter(w)
+	if _, err := sheet.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`); err != nil {
+		return nil, fmt.Errorf("xlsx error: %w", err)
+	}
+	return &xlsxWriter{zw: zw, sheet: sheet}, nil
+}
+
+func (x *xlsxWriter) WriteRow(row []string) error {
+	x.rows++
+	if _, err := fmt.Fprintf(x.sheet, `<row r="%d">`, x.rows); err != nil {
+		return fmt.Errorf("xlsx error: %w", err)
+	}
+	for _, value := range row {
+		if _, err := x.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`); err != nil {
+			return fmt.Errorf("xlsx error: %w", err)
+		}
+		if err := xml.EscapeText(x.sheet, []byte(xlsxSafe(value))); err != nil {
+			return fmt.Errorf("xlsx error: %w", err)
+		}
+		if _, err := x.sheet.WriteString(`</t></is></c>`); err != nil {
+			return fmt.Errorf("xlsx error: %w", err)
+		}
+	}
+	if _, err := x.sheet.WriteString(`</row>`); err != nil {
+		return fmt.Errorf("xlsx error: %w", err)
+	}
+	return nil
+}
+
+func (x *xlsxWriter) Close() error {
+	if _, err := x.sheet.WriteString(`</sheetData></worksheet>`); err != nil {
+		return fmt.Errorf("xlsx error: %w", err)
+	}
+	if err := x.sheet.Flush(); err != nil {
+		return fmt.Errorf("xlsx error: %w", err)
+	}
+	return x.zw.Close()
+}
+
+// xlsxSafe truncates to the 32767 characters a cell can hold and drops
+// control characters XML 1.0 does not allow.
+func xlsxSafe(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, value)
+	if runes := []rune(value); len(runes) > 32767 {
+		value = string(runes[:32767])
+	}
+	return value
+}
@@ -1,27 +1,33 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"strings"
 )
 
+// FilterAlerts returns the alerts matched by a suppression rule, each
+// carrying the first rule that matched it.
 func FilterAlerts(allAlerts []Alert, config JsonConfig) []Alert {
-	if !config.FilterMode || len(config.Filters) == 0 {
+	rules := SuppressionRules(config)
+	if !config.FilterMode || len(rules) == 0 {
 		return allAlerts
 	}
 
 	var filtered []Alert
 	for _, alert := range allAlerts {
-		if matchesFilters(alert, config.Filters, config.Debug) {
-			filtered = append(filtered, alert)
+		for i := range rules {
+			// A suppression without filters must not select every alert
+			if len(rules[i].Filters) > 0 && matchesFilters(alert, rules[i].Filters, config.Debug) {
+				if config.Debug {
+					fmt.Printf("Matched suppression %q: %s\n", rules[i].Name, alert.InternalID)
+				}
+				alert.suppression = &rules[i]
+				filtered = append(filtered, alert)
+				break
+			}
 		}
 	}
 
-	if config.Debug {
-		fmt.Printf("Filtered %d alerts from %d total\n", len(filtered), len(allAlerts))
-	}
-
 	return filtered
 }
 
@@ -65,15 +71,8 @@ func matchFilter(alert Alert, filter Filter, debug bool) bool {
 
 func matchObservable(observables []Observable, field, value string, debug bool) bool {
 	for _, obs := range observables {
-		var fieldValue string
-		switch strings.ToLower(field) {
-		case "value":
-			fieldValue = obs.Value
-		case "type":
-			fieldValue = obs.Type
-		case "details":
-			fieldValue = obs.Details
-		default:
+		fieldValue, ok := observableField(obs, field)
+		if !ok {
 			continue
 		}
 
@@ -89,19 +88,8 @@ func matchObservable(observables []Observable, field, value string, debug bool)
 
 func matchRule(rules []Rule, field, value string, debug bool) bool {
 	for _, rule := range rules {
-		var fieldValue string
-		switch strings.ToLower(field) {
-		case "name":
-			fieldValue = rule.Name
-		case "id":
-			fieldValue = rule.ID
-		case "type":
-			fieldValue = rule.Type
-		case "severity":
-			fieldValue = rule.Severity
-		case "confidence":
-			fieldValue = rule.Confidence
-		default:
+		fieldValue, ok := ruleField(rule, field)
+		if !ok {
 			continue
 		}
 
@@ -118,35 +106,8 @@ func matchRule(rules []Rule, field, value string, debug bool) bool {
 func matchBaseEvent(events []OriginalEvent, field, value string, debug bool) bool {
 	for _, event := range events {
 		for _, baseEvent := range event.BaseEvents {
-			var fieldValue string
-			switch strings.ToLower(field) {
-			case "destinationaddress":
-				fieldValue = baseEvent.DestinationAddress
-			case "sourceaddress":
-				fieldValue = baseEvent.SourceAddress
-			case "deviceaddress":
-				fieldValue = baseEvent.DeviceAddress
-			case "devicehostname":
-				fieldValue = baseEvent.DeviceHostName
-			case "deviceaction":
-				fieldValue = baseEvent.DeviceAction
-			case "devicevendor":
-				fieldValue = baseEvent.DeviceVendor
-			case "deviceproduct":
-				fieldValue = baseEvent.DeviceProduct
-			case "transportprotocol":
-				fieldValue = baseEvent.TransportProtocol
-			case "applicationprotocol":
-				fieldValue = baseEvent.ApplicationProtocol
-			case "message":
-				fieldValue = baseEvent.Message
-			case "name":
-				fieldValue = baseEvent.Name
-			case "destinationport":
-				fieldValue = fmt.Sprintf("%d", baseEvent.DestinationPort)
-			case "sourceport":
-				fieldValue = fmt.Sprintf("%d", baseEvent.SourcePort)
-			default:
+			fieldValue, ok := baseEventField(baseEvent, field)
+			if !ok {
 				continue
 			}
 
@@ -162,21 +123,8 @@ func matchBaseEvent(events []OriginalEvent, field, value string, debug bool) boo
 }
 
 func matchAlertField(alert Alert, field, value string, debug bool) bool {
-	var fieldValue string
-	switch strings.ToLower(field) {
-	case "name":
-		fieldValue = alert.Name
-	case "severity":
-		fieldValue = alert.Severity
-	case "status":
-		fieldValue = alert.Status
-	case "internalid":
-		fieldValue = alert.InternalID
-	case "incidentid":
-		fieldValue = alert.IncidentID
-	case "externalref":
-		fieldValue = alert.ExternalRef
-	default:
+	fieldValue, ok := alertField(alert, field)
+	if !ok {
 		return false
 	}
 
@@ -189,18 +137,80 @@ func matchAlertField(alert Alert, field, value string, debug bool) bool {
 	return false
 }
 
-func SaveFilteredAlerts(alerts []Alert, filename string) error {
-	out := AlertsFile{Alerts: alerts}
-	fileData, err := json.MarshalIndent(out, "", "  ")
-	if err != nil {
-		return fmt.Errorf("JSON marshal error: %w", err)
+func observableField(obs Observable, field string) (string, bool) {
+	switch strings.ToLower(field) {
+	case "value":
+		return obs.Value, true
+	case "type":
+		return obs.Type, true
+	case "details":
+		return obs.Details, true
 	}
+	return "", false
+}
 
-	err = FilePutContentsBytes(filename, fileData)
-	if err != nil {
-		return fmt.Errorf("write error: %w", err)
+func ruleField(rule Rule, field string) (string, bool) {
+	switch strings.ToLower(field) {
+	case "name":
+		return rule.Name, true
+	case "id":
+		return rule.ID, true
+	case "type":
+		return rule.Type, true
+	case "severity":
+		return rule.Severity, true
+	case "confidence":
+		return rule.Confidence, true
+	}
+	return "", false
+}
+
+func baseEventField(baseEvent BaseEvent, field string) (string, bool) {
+	switch strings.ToLower(field) {
+	case "destinationaddress":
+		return baseEvent.DestinationAddress, true
+	case "sourceaddress":
+		return baseEvent.SourceAddress, true
+	case "deviceaddress":
+		return baseEvent.DeviceAddress, true
+	case "devicehostname":
+		return baseEvent.DeviceHostName, true
+	case "deviceaction":
+		return baseEvent.DeviceAction, true
+	case "devicevendor":
+		return baseEvent.DeviceVendor, true
+	case "deviceproduct":
+		return baseEvent.DeviceProduct, true
+	case "transportprotocol":
+		return baseEvent.TransportProtocol, true
+	case "applicationprotocol":
+		return baseEvent.ApplicationProtocol, true
+	case "message":
+		return baseEvent.Message, true
+	case "name":
+		return baseEvent.Name, true
+	case "destinationport":
+		return fmt.Sprintf("%d", baseEvent.DestinationPort), true
+	case "sourceport":
+		return fmt.Sprintf("%d", baseEvent.SourcePort), true
 	}
+	return "", false
+}
 
-	fmt.Printf("Saved %d filtered alerts to %s\n", len(alerts), filename)
-	return nil
+func alertField(alert Alert, field string) (string, bool) {
+	switch strings.ToLower(field) {
+	case "name":
+		return alert.Name, true
+	case "severity":
+		return alert.Severity, true
+	case "status":
+		return alert.Status, true
+	case "internalid":
+		return alert.InternalID, true
+	case "incidentid":
+		return alert.IncidentID, true
+	case "externalref":
+		return alert.ExternalRef, true
+	}
+	return "", false
 }
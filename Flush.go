@@ -1,25 +1,48 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 )
 
 type FlushManager struct {
 	mu            sync.Mutex
 	outfile       string
+	format        string
+	compression   string
 	flushEvery    int
 	currentAlerts []Alert
 	totalFlushed  int
 	debug         bool
 	firstWrite    bool
+	checkpoint    *Checkpoint
+	pendingPages  map[string]CheckpointPage
+	splitAlerts   int
+	splitBytes    int64
+	chunk         int
+	chunks        []ManifestChunk
+	fileAlerts    int
+	fileSize      int64
+	run           *Run
+	err           error
 }
 
-func NewFlushManager(outfile string, flushEvery int, debug bool) *FlushManager {
+// NewFlushManager writes a {"Alerts": [...]} document, or one alert per line
+// when format is "ndjson". With a compression ("gzip" or "zstd") every flush
+// is appended as its own compressed member. Flushes go to a temporary file
+// (see tempName) that Finalize renames to outfile, so the previous outfile
+// stays intact until the new one is complete.
+func NewFlushManager(outfile string, flushEvery int, format string, compression string, debug bool) *FlushManager {
 	return &FlushManager{
 		outfile:       outfile,
+		format:        format,
+		compression:   compression,
 		flushEvery:    flushEvery,
 		currentAlerts: make([]Alert, 0, flushEvery),
 		debug:         debug,
@@ -27,6 +50,102 @@ func NewFlushManager(outfile string, flushEvery int, debug bool) *FlushManager {
 	}
 }
 
+// SetRun writes the run metadata at the head of every output document and,
+// once run.Finish has been called, the run result at their end. An NDJSON
+// output gets them in its manifest or in the MetadataPath file instead.
+func (fm *FlushManager) SetRun(run *Run) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.run = run
+}
+
+// SetSplit writes the output as numbered chunk files (see ChunkName) of at
+// most maxAlerts alerts, or of about maxBytes since the size is checked
+// after each flush, plus a manifest listing them. Zero disables a limit.
+// Must be called before EnableCheckpoint.
+func (fm *FlushManager) SetSplit(maxAlerts int, maxBytes int64) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	fm.splitAlerts = maxAlerts
+	fm.splitBytes = maxBytes
+	if maxAlerts > 0 || maxBytes > 0 {
+		fm.chunk = 1
+	}
+}
+
+// Path returns the file to read the output back from: the outfile, or the
+// manifest when the output is split.
+func (fm *FlushManager) Path() string {
+	if fm.chunk > 0 {
+		return ManifestPath(fm.outfile)
+	}
+	return fm.outfile
+}
+
+// currentFile is the final name of the file flushes go to.
+func (fm *FlushManager) currentFile() string {
+	if fm.chunk > 0 {
+		return ChunkName(fm.outfile, fm.chunk)
+	}
+	return fm.outfile
+}
+
+// tempName is where filename is written until Finalize. It stays in the
+// same directory so that the rename is atomic.
+func tempName(filename string) string {
+	return filename + ".tmp"
+}
+
+// EnableCheckpoint records flushed pages in cp. When cp holds a previous
+// run's progress the file being written is truncated to the last
+// checkpointed offset and further flushes append to it.
+func (fm *FlushManager) EnableCheckpoint(cp *Checkpoint) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	fm.checkpoint = cp
+	fm.pendingPages = make(map[string]CheckpointPage)
+	if !cp.Resumable() {
+		return nil
+	}
+	if fm.chunk > 0 {
+		fm.chunk = cp.Chunk
+		fm.chunks = append([]ManifestChunk(nil), cp.Chunks...)
+	}
+	if cp.Offset > 0 {
+		if err := os.Truncate(tempName(fm.currentFile()), cp.Offset); err != nil {
+			return fmt.Errorf("resume truncate error: %w", err)
+		}
+		fm.firstWrite = false
+	}
+	fm.totalFlushed = cp.Flushed
+	fm.fileAlerts = cp.ChunkAlerts
+	fm.fileSize = cp.Offset
+	if fm.debug {
+		fmt.Printf("Resuming %s: %d alerts from %d pages already written\n", fm.outfile, cp.Flushed, len(cp.Pages))
+	}
+	return nil
+}
+
+// AddPage buffers the alerts of a page; the page is checkpointed once they
+// have all been flushed.
+func (fm *FlushManager) AddPage(key string, alerts []Alert, last bool) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	if fm.checkpoint != nil {
+		fm.pendingPages[key] = CheckpointPage{Alerts: len(alerts), Last: last}
+	}
+	fm.currentAlerts = append(fm.currentAlerts, alerts...)
+
+	if len(fm.currentAlerts) >= fm.flushEvery {
+		return fm.flush()
+	}
+
+	return nil
+}
+
 func (fm *FlushManager) AddAlerts(alerts []Alert) error {
 	fm.mu.Lock()
 	defer fm.mu.Unlock()
@@ -40,50 +159,238 @@ func (fm *FlushManager) AddAlerts(alerts []Alert) error {
 	return nil
 }
 
+// flush writes the buffered alerts. After a failed write the temporary file
+// may hold part of them, so the error is kept and every later flush, and
+// Finalize, returns it instead of writing or publishing.
 func (fm *FlushManager) flush() error {
-	if len(fm.currentAlerts) == 0 {
-		return nil
+	if fm.err != nil {
+		return fm.err
 	}
-
-	if fm.debug {
+	if len(fm.currentAlerts) > 0 && fm.debug {
 		fmt.Printf("Flushing %d alerts to disk (total flushed: %d)...\n", len(fm.currentAlerts), fm.totalFlushed+len(fm.currentAlerts))
 	}
 
+	pending := fm.currentAlerts
+	for len(pending) > 0 {
+		batch := pending
+		if fm.splitAlerts > 0 && fm.fileAlerts+len(batch) > fm.splitAlerts {
+			batch = batch[:fm.splitAlerts-fm.fileAlerts]
+		}
+		if err := fm.write(batch); err != nil {
+			fm.err = err
+			return err
+		}
+		pending = pending[len(batch):]
+
+		if fm.chunkFull() {
+			if err := fm.rotate(); err != nil {
+				fm.err = err
+				return err
+			}
+		}
+	}
+	fm.currentAlerts = fm.currentAlerts[:0]
+
+	return fm.commitCheckpoint()
+}
+
+// write appends batch to the current file as one compressed member.
+func (fm *FlushManager) write(batch []Alert) error {
 	var file *os.File
 	var err error
 
 	if fm.firstWrite {
-		file, err = os.Create(fm.outfile)
+		file, err = os.Create(tempName(fm.currentFile()))
 		if err != nil {
 			return fmt.Errorf("create file error: %w", err)
 		}
-		_, _ = file.WriteString("{\n  \"Alerts\": [\n")
-		fm.firstWrite = false
 	} else {
-		file, err = os.OpenFile(fm.outfile, os.O_WRONLY|os.O_APPEND, 0644)
+		file, err = os.OpenFile(tempName(fm.currentFile()), os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
 			return fmt.Errorf("open file error: %w", err)
 		}
 	}
 	defer file.Close()
 
-	for i, alert := range fm.currentAlerts {
+	w, err := newCompressor(file, fm.compression)
+	if err != nil {
+		return err
+	}
+	if fm.firstWrite {
+		head, err := fm.head()
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, head); err != nil {
+			return fmt.Errorf("write error: %w", err)
+		}
+	}
+
+	if fm.format == "ndjson" {
+		err = fm.writeLines(w, batch)
+	} else {
+		err = fm.writeDocument(w, batch)
+	}
+	if err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("compress error: %w", err)
+	}
+	if fm.checkpoint != nil {
+		if err := file.Sync(); err != nil {
+			return fmt.Errorf("sync error: %w", err)
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat error: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close error: %w", err)
+	}
+
+	fm.firstWrite = false
+	fm.totalFlushed += len(batch)
+	fm.fileAlerts += len(batch)
+	fm.fileSize = info.Size()
+	return nil
+}
+
+// writeLines appends batch as newline-delimited JSON, one alert per line.
+func (fm *FlushManager) writeLines(out io.Writer, batch []Alert) error {
+	w := bufio.NewWriter(out)
+	for _, alert := range batch {
+		alertJSON, err := json.Marshal(alert)
+		if err != nil {
+			return fmt.Errorf("marshal error: %w", err)
+		}
+		if _, err := w.Write(alertJSON); err != nil {
+			return fmt.Errorf("write error: %w", err)
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return fmt.Errorf("write error: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	return nil
+}
+
+// writeDocument appends batch to the "Alerts" array of the document.
+func (fm *FlushManager) writeDocument(w io.Writer, batch []Alert) error {
+	for i, alert := range batch {
 		alertJSON, err := json.MarshalIndent(alert, "    ", "  ")
 		if err != nil {
 			return fmt.Errorf("marshal error: %w", err)
 		}
 
-		if fm.totalFlushed > 0 || i > 0 {
-			_, _ = file.WriteString(",\n")
+		separator := "    "
+		if fm.fileAlerts > 0 || i > 0 {
+			separator = ",\n    "
+		}
+		if _, err := io.WriteString(w, separator); err != nil {
+			return fmt.Errorf("write error: %w", err)
 		}
+		if _, err := w.Write(alertJSON); err != nil {
+			return fmt.Errorf("write error: %w", err)
+		}
+	}
+	return nil
+}
 
-		_, _ = file.WriteString("    ")
-		_, _ = file.Write(alertJSON)
+func (fm *FlushManager) chunkFull() bool {
+	if fm.chunk == 0 {
+		return false
 	}
+	return (fm.splitAlerts > 0 && fm.fileAlerts >= fm.splitAlerts) ||
+		(fm.splitBytes > 0 && fm.fileSize >= fm.splitBytes)
+}
 
-	fm.totalFlushed += len(fm.currentAlerts)
-	fm.currentAlerts = fm.currentAlerts[:0]
+// rotate closes the current chunk and starts the next one.
+func (fm *FlushManager) rotate() error {
+	if err := fm.writeFooter(); err != nil {
+		return err
+	}
+	if err := fm.recordChunk(); err != nil {
+		return err
+	}
+	if fm.debug {
+		fmt.Printf("Chunk %s completed: %d alerts\n", fm.currentFile(), fm.fileAlerts)
+	}
+	fm.chunk++
+	fm.fileAlerts = 0
+	fm.fileSize = 0
+	fm.firstWrite = true
+	return nil
+}
+
+// recordChunk adds the completed current chunk to the manifest.
+func (fm *FlushManager) recordChunk() error {
+	sum, size, err := fileChecksum(tempName(fm.currentFile()))
+	if err != nil {
+		return fmt.Errorf("checksum error: %w", err)
+	}
+	fm.chunks = append(fm.chunks, ManifestChunk{
+		File:   filepath.Base(fm.currentFile()),
+		Alerts: fm.fileAlerts,
+		Bytes:  size,
+		SHA256: sum,
+	})
+	return nil
+}
+
+// head and tail are empty in NDJSON, which holds nothing but alert lines.
+func (fm *FlushManager) head() (string, error) {
+	if fm.format == "ndjson" {
+		return "", nil
+	}
+	return fm.run.documentHead()
+}
+
+func (fm *FlushManager) tail() (string, error) {
+	if fm.format == "ndjson" {
+		return "", nil
+	}
+	return fm.run.documentTail(fm.fileAlerts)
+}
+
+// writeFooter closes the "Alerts" array and adds the run result when known.
+// NDJSON needs no closing since the file is valid after every flush.
+func (fm *FlushManager) writeFooter() error {
+	tail, err := fm.tail()
+	if err != nil || tail == "" {
+		return err
+	}
+	if err := fm.writeMember(os.O_WRONLY|os.O_APPEND, tail); err != nil {
+		return fmt.Errorf("finalize error: %w", err)
+	}
+	return nil
+}
 
+func (fm *FlushManager) commitCheckpoint() error {
+	if fm.checkpoint == nil || len(fm.pendingPages) == 0 {
+		return nil
+	}
+	// Pages without alerts are committed once the output has been started
+	// by this run.
+	if fm.firstWrite && len(fm.chunks) == 0 {
+		return nil
+	}
+	progress := FlushProgress{
+		Flushed:     fm.totalFlushed,
+		Chunk:       fm.chunk,
+		ChunkAlerts: fm.fileAlerts,
+		Chunks:      append([]ManifestChunk(nil), fm.chunks...),
+	}
+	if !fm.firstWrite {
+		progress.Offset = fm.fileSize
+	}
+	if err := fm.checkpoint.Commit(fm.pendingPages, progress); err != nil {
+		return err
+	}
+	fm.pendingPages = make(map[string]CheckpointPage)
 	return nil
 }
 
@@ -95,23 +402,280 @@ func (fm *FlushManager) Finalize() error {
 		return err
 	}
 
-	file, err := os.OpenFile(fm.outfile, os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return fmt.Errorf("finalize open error: %w", err)
+	switch {
+	case !fm.firstWrite:
+		if err := fm.writeFooter(); err != nil {
+			return err
+		}
+		if fm.chunk > 0 {
+			if err := fm.recordChunk(); err != nil {
+				return err
+			}
+		}
+	case fm.chunk == 0 || len(fm.chunks) == 0:
+		// Nothing was flushed (e.g. no new alerts in incremental mode):
+		// still produce a valid empty document.
+		fm.firstWrite = false
+		head, err := fm.head()
+		if err != nil {
+			return err
+		}
+		tail, err := fm.tail()
+		if err != nil {
+			return err
+		}
+		empty := strings.TrimSuffix(head, "\n") + tail
+		if err := fm.writeMember(os.O_WRONLY|os.O_CREATE|os.O_TRUNC, empty); err != nil {
+			return err
+		}
+		if fm.chunk > 0 {
+			if err := fm.recordChunk(); err != nil {
+				return err
+			}
+		}
 	}
-	defer file.Close()
 
-	_, _ = file.WriteString("\n  ]\n}\n")
+	if err := fm.publish(); err != nil {
+		return err
+	}
 
 	if fm.debug {
-		fmt.Printf("Finalized: total %d alerts written to %s\n", fm.totalFlushed, fm.outfile)
+		fmt.Printf("Finalized: total %d alerts written to %s\n", fm.totalFlushed, fm.Path())
 	}
 
+	if fm.checkpoint != nil {
+		return fm.checkpoint.Remove()
+	}
 	return nil
 }
 
+// Keep ends an incomplete run: the buffered alerts are flushed and the
+// current temporary file closed, but nothing is published, so the previous
+// output stays in place, and the checkpoint is kept for the next run to
+// resume from.
+func (fm *FlushManager) Keep() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+
+	if err := fm.flush(); err != nil {
+		return err
+	}
+	if fm.firstWrite {
+		return nil
+	}
+	return fm.writeFooter()
+}
+
+// TempPath is the temporary file flushes currently go to.
+func (fm *FlushManager) TempPath() string {
+	return tempName(fm.currentFile())
+}
+
+// publish renames the completed temporary files to their final names. When
+// the output is split the manifest is written last, once every chunk it
+// lists is in place.
+func (fm *FlushManager) publish() error {
+	if fm.chunk == 0 {
+		if err := renameTemp(fm.outfile); err != nil {
+			return err
+		}
+		if fm.format == "ndjson" && fm.run != nil {
+			return fm.run.SaveRecord(fm.totalFlushed, MetadataPath(fm.outfile))
+		}
+		return nil
+	}
+	dir := filepath.Dir(fm.outfile)
+	for _, chunk := range fm.chunks {
+		if err := renameTemp(filepath.Join(dir, chunk.File)); err != nil {
+			return err
+		}
+	}
+	manifest := Manifest{Format: fm.format, Compression: fm.compression, Total: fm.totalFlushed, Chunks: fm.chunks}
+	if fm.run != nil {
+		record := fm.run.record(fm.totalFlushed)
+		manifest.Metadata = record.Metadata
+		manifest.Result = record.Result
+	}
+	return SaveManifest(manifest, fm.Path())
+}
+
+func renameTemp(filename string) error {
+	if err := renameSynced(tempName(filename), filename); err != nil {
+		return fmt.Errorf("rename error: %w", err)
+	}
+	return nil
+}
+
+// writeMember writes content to the current file as one compressed member.
+func (fm *FlushManager) writeMember(flag int, content string) error {
+	file, err := os.OpenFile(tempName(fm.currentFile()), flag, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := newCompressor(file, fm.compression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("compress error: %w", err)
+	}
+	return file.Close()
+}
+
 func (fm *FlushManager) GetTotalFlushed() int {
 	fm.mu.Lock()
 	defer fm.mu.Unlock()
 	return fm.totalFlushed + len(fm.currentAlerts)
 }
+
+// StreamAlertsFile decodes the alerts of an AlertsFile document or of an
+// NDJSON dump one at a time, so a dump of any size is read with constant
+// memory. A manifest streams the alerts of all its chunks in order.
+func StreamAlertsFile(filename string, fn func(Alert) error) error {
+	if isManifest(filename) {
+		files, err := chunkFiles(filename)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range files {
+			if err := StreamAlertsFile(chunk, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("open error: %w", err)
+	}
+	defer file.Close()
+
+	r, closeReader, err := decompressed(bufio.NewReader(file))
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	// The first value tells the format: an object with an "Alerts" key is
+	// a document, anything else is the first line of an NDJSON dump.
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("JSON error: %w", err)
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("JSON error: %s is neither an alerts document nor NDJSON", filename)
+	}
+	first := make(map[string]json.RawMessage)
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("JSON error: %w", err)
+		}
+		if key == "Alerts" {
+			return streamDocument(dec, fn)
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return fmt.Errorf("JSON error: %w", err)
+		}
+		first[key.(string)] = value
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("JSON error: %w", err)
+	}
+	line, err := json.Marshal(first)
+	if err != nil {
+		return fmt.Errorf("JSON error: %w", err)
+	}
+	if err := decodeAlertLine(line, fn); err != nil {
+		return err
+	}
+	return streamAlertLines(dec, fn)
+}
+
+// streamDocument decodes the alerts of a document whose "Alerts" key has
+// just been read, then skips the keys that follow.
+func streamDocument(dec *json.Decoder, fn func(Alert) error) error {
+	for {
+		if err := streamAlertsArray(dec, fn); err != nil {
+			return err
+		}
+		for {
+			if !dec.More() {
+				return nil
+			}
+			key, err := dec.Token()
+			if err != nil {
+				return fmt.Errorf("JSON error: %w", err)
+			}
+			if key == "Alerts" {
+				break
+			}
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return fmt.Errorf("JSON error: %w", err)
+			}
+		}
+	}
+}
+
+func streamAlertsArray(dec *json.Decoder, fn func(Alert) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("JSON error: %w", err)
+	}
+	if tok == nil {
+		// "Alerts": null
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("JSON error: Alerts is not an array")
+	}
+	for dec.More() {
+		var alert Alert
+		if err := dec.Decode(&alert); err != nil {
+			return fmt.Errorf("JSON error: %w", err)
+		}
+		if err := fn(alert); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("JSON error: %w", err)
+	}
+	return nil
+}
+
+func decodeAlertLine(data []byte, fn func(Alert) error) error {
+	var alert Alert
+	if err := json.Unmarshal(data, &alert); err != nil {
+		return fmt.Errorf("JSON error: %w", err)
+	}
+	return fn(alert)
+}
+
+func streamAlertLines(dec *json.Decoder, fn func(Alert) error) error {
+	for {
+		var line json.RawMessage
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("JSON error: %w", err)
+		}
+		if err := decodeAlertLine(line, fn); err != nil {
+			return err
+		}
+	}
+}
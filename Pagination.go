@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PageState int
+
+const (
+	PagePending PageState = iota
+	PageDone
+	PageFailed
+)
+
+// PageTracker hands out page numbers to the fetch workers and records the
+// outcome of every page so that gaps are reported instead of silently lost.
+type PageTracker struct {
+	mu                  sync.Mutex
+	next                int
+	lastPage            int
+	states              map[int]PageState
+	errors              map[int]error
+	alerts              int
+	consecutiveFailures int
+	maxFailures         int
+	aborted             bool
+}
+
+type FetchReport struct {
+	Pages       int
+	Alerts      int
+	Duplicates  int
+	Gaps        []PageGap
+	Aborted     bool
+	Interrupted bool
+	HighWater   map[string]time.Time
+}
+
+// PageGap is a page that could not be fetched. Window is set when the page
+// belongs to a time window of the "windows" fetch strategy.
+type PageGap struct {
+	Window string
+	Page   int
+	Err    error
+}
+
+func NewPageTracker(firstPage int, maxFailures int) *PageTracker {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	return &PageTracker{
+		next:        firstPage,
+		lastPage:    -1,
+		states:      make(map[int]PageState),
+		errors:      make(map[int]error),
+		maxFailures: maxFailures,
+	}
+}
+
+// Next returns the next page to fetch, or false once the end of data is
+// known or too many consecutive pages failed.
+func (pt *PageTracker) Next() (int, bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if pt.aborted {
+		return 0, false
+	}
+	if pt.lastPage >= 0 && pt.next > pt.lastPage {
+		return 0, false
+	}
+	page := pt.next
+	pt.next++
+	pt.states[page] = PagePending
+	return page, true
+}
+
+// Done records a successful page. last marks the page as the end of the
+// data set; pages after it are no longer handed out.
+func (pt *PageTracker) Done(page int, count int, last bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.states[page] = PageDone
+	pt.alerts += count
+	pt.consecutiveFailures = 0
+	if last && (pt.lastPage < 0 || page < pt.lastPage) {
+		pt.lastPage = page
+	}
+}
+
+func (pt *PageTracker) Fail(page int, err error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.states[page] = PageFailed
+	pt.errors[page] = err
+	pt.consecutiveFailures++
+	if pt.consecutiveFailures >= pt.maxFailures {
+		pt.aborted = true
+	}
+}
+
+func (pt *PageTracker) Report() FetchReport {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	report := FetchReport{
+		Alerts:  pt.alerts,
+		Aborted: pt.aborted,
+	}
+	for page, state := range pt.states {
+		// Pages past the end of data can fail harmlessly.
+		if pt.lastPage >= 0 && page > pt.lastPage {
+			continue
+		}
+		report.Pages++
+		if state != PageDone {
+			err := pt.errors[page]
+			if err == nil {
+				err = fmt.Errorf("not fetched")
+			}
+			report.Gaps = append(report.Gaps, PageGap{Page: page, Err: err})
+		}
+	}
+	sort.Slice(report.Gaps, func(i, j int) bool { return report.Gaps[i].Page < report.Gaps[j].Page })
+	return report
+}
+
+func (r FetchReport) Complete() bool {
+	return len(r.Gaps) == 0 && !r.Aborted && !r.Interrupted
+}
+
+// Merge adds the counters and gaps of another report into r.
+func (r *FetchReport) Merge(other FetchReport) {
+	r.Pages += other.Pages
+	r.Alerts += other.Alerts
+	r.Duplicates += other.Duplicates
+	r.Gaps = append(r.Gaps, other.Gaps...)
+	r.Aborted = r.Aborted || other.Aborted
+	r.Interrupted = r.Interrupted || other.Interrupted
+}
+
+func (r FetchReport) Print() {
+	fmt.Printf("Pages fetched: %d, alerts: %d\n", r.Pages, r.Alerts)
+	if r.Duplicates > 0 {
+		fmt.Printf("Duplicates skipped: %d\n", r.Duplicates)
+	}
+	if r.Interrupted {
+		fmt.Println("WARNING: fetch interrupted, remaining pages were not requested")
+	}
+	if r.Aborted {
+		fmt.Println("WARNING: pagination aborted after too many consecutive page failures, end of data was never reached")
+	}
+	if len(r.Gaps) > 0 {
+		fmt.Printf("WARNING: incomplete dataset, %d page(s) missing:\n", len(r.Gaps))
+		for _, gap := range r.Gaps {
+			if gap.Window != "" {
+				fmt.Printf("  window %s page %d: %v\n", gap.Window, gap.Page, gap.Err)
+				continue
+			}
+			fmt.Printf("  page %d: %v\n", gap.Page, gap.Err)
+		}
+	}
+}
+
+func fetchPageWithRetry(ctx context.Context, client *http.Client, config JsonConfig, pageNum int) PageResult {
+	var result PageResult
+	for attempt := 1; attempt <= config.PageRetries; attempt++ {
+		result = fetchPage(ctx, client, config, pageNum)
+		if result.Err == nil || !retryableStatus(result.Status) {
+			return result
+		}
+		if attempt < config.PageRetries {
+			if config.Debug {
+				fmt.Printf("Retrying page %d (attempt %d/%d): %v\n", pageNum, attempt+1, config.PageRetries, result.Err)
+			}
+			select {
+			case <-time.After(time.Second * time.Duration(1<<(attempt-1))):
+			case <-ctx.Done():
+				return result
+			}
+		}
+	}
+	return result
+}
+
+// retryableStatus reports whether a failed page is worth fetching again.
+// Transport errors (no status) and truncated 200 bodies are always retried.
+func retryableStatus(status int) bool {
+	if status == 0 || status == http.StatusOK {
+		return true
+	}
+	return status == 429 || status >= 500
+}
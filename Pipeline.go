@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Pipeline streams fetched pages to the outfile, to the alert store when one
+// is set and, in filter mode, through the filters into the filtered outfile. Memory stays bounded by
+// the flush buffers: only the matches to close are kept, without their
+// events, unless they are handed to a CloseQueue as soon as they match.
+type Pipeline struct {
+	config   JsonConfig
+	out      *FlushManager
+	store    *AlertStore
+	filtered *FlushManager
+	deferred bool
+	closer   *CloseQueue
+	matches  []Alert
+	refused  []CloseEntry
+	closed   map[string]bool
+	skipped  []CloseEntry
+	pending  map[string]alertMark
+	fetched  int
+	scanned  int
+	matched  int
+	err      error
+}
+
+func NewPipeline(config JsonConfig, run *Run, out *FlushManager) *Pipeline {
+	p := &Pipeline{config: config, out: out}
+	if config.FilterMode {
+		p.filtered = NewFlushManager(config.FilteredOutfile, config.FlushEvery, config.OutputFormat, CompressionFor(config.FilteredOutfile, config.Compression), config.Debug)
+		p.filtered.SetSplit(config.SplitEvery, int64(config.SplitEveryMB)<<20)
+		p.filtered.SetRun(run)
+	}
+	return p
+}
+
+// DeferFiltering writes pages without filtering them; Replay then filters
+// the complete outfile. Used when resuming, since the alerts of the pages
+// written before the restart are only on disk.
+func (p *Pipeline) DeferFiltering() {
+	p.deferred = true
+}
+
+// SaveTo upserts every fetched page into store.
+func (p *Pipeline) SaveTo(store *AlertStore) {
+	p.store = store
+}
+
+// SkipClosed keeps the alerts in closed, closed by a previous run, and the
+// alerts whose status is closed from being closed again.
+func (p *Pipeline) SkipClosed(closed map[string]bool) {
+	p.closed = closed
+}
+
+// StreamClose starts closing matches while pages are still being fetched,
+// unless the close limits or the confirmation need all of them first.
+func (p *Pipeline) StreamClose(ctx context.Context, client *http.Client, audit *AuditLog) {
+	if p.filtered == nil || !p.config.CloseAlerts {
+		return
+	}
+	if needsAllMatches(p.config) {
+		fmt.Println("WARNING: streamClose disabled, close limits and confirmation need all matches first")
+		return
+	}
+	p.closer = StartCloseQueue(ctx, p.config, client, audit)
+}
+
+// Closer returns the CloseQueue started by StreamClose, if any.
+func (p *Pipeline) Closer() *CloseQueue {
+	return p.closer
+}
+
+func (p *Pipeline) HandlePage(result PageResult) {
+	p.fetched += len(result.Alerts)
+
+	// Stored before the page can be checkpointed by the flush below, so a
+	// resumed run never skips a page the store has not seen.
+	if p.store != nil {
+		if err := p.store.Upsert(result.Alerts, time.Now()); err != nil {
+			fmt.Printf("Store error: %v\n", err)
+			p.setErr(err)
+		}
+	}
+
+	if err := p.out.AddPage(result.Key, result.Alerts, result.Last); err != nil {
+		fmt.Printf("Flush error: %v\n", err)
+		p.setErr(err)
+	}
+
+	if !p.deferred {
+		p.filter(result.Alerts)
+	}
+
+	if p.config.Debug {
+		fmt.Printf("Page %d completed: %d alerts (fetched: %d, matched: %d)\n", result.PageNum, len(result.Alerts), p.fetched, p.matched)
+	}
+}
+
+func (p *Pipeline) filter(alerts []Alert) {
+	if p.filtered == nil {
+		return
+	}
+	p.scanned += len(alerts)
+	matches := FilterAlerts(alerts, p.config)
+	if len(matches) == 0 {
+		return
+	}
+	p.matched += len(matches)
+	if err := p.filtered.AddAlerts(matches); err != nil {
+		fmt.Printf("Flush error: %v\n", err)
+		p.setErr(err)
+	}
+	if !p.config.CloseAlerts {
+		return
+	}
+	for _, alert := range matches {
+		if p.closed != nil && alertRule(alert, p.config).Action == "close" && (alreadyClosed(alert) || p.closed[alert.InternalID]) {
+			p.skipped = append(p.skipped, CloseEntry{ID: alert.InternalID, Name: alert.Name, TenantID: alert.TenantID})
+			continue
+		}
+		if reason := closeRefusal(alert, p.config); reason != "" {
+			p.refused = append(p.refused, CloseEntry{ID: alert.InternalID, Name: alert.Name, TenantID: alert.TenantID, Error: reason})
+			continue
+		}
+		p.track(alert)
+		if p.closer != nil {
+			p.closer.Add(slimAlert(alert))
+			continue
+		}
+		p.matches = append(p.matches, slimAlert(alert))
+	}
+}
+
+// Replay runs every alert of filename through the filters.
+func (p *Pipeline) Replay(filename string) error {
+	return StreamAlertsFile(filename, p.replayAlert)
+}
+
+// ReplayStore runs the stored alerts matching where through the filters.
+func (p *Pipeline) ReplayStore(store *AlertStore, where string) error {
+	return store.Each(where, p.replayAlert)
+}
+
+func (p *Pipeline) replayAlert(alert Alert) error {
+	p.filter([]Alert{alert})
+	return p.err
+}
+
+// Err returns the first store or flush error of the run.
+func (p *Pipeline) Err() error {
+	return p.err
+}
+
+// Finalize closes the filtered outfile, published only when complete; the
+// outfile is finalized by its owner.
+func (p *Pipeline) Finalize(complete bool) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.filtered == nil {
+		return nil
+	}
+	if !complete {
+		if err := p.filtered.Keep(); err != nil {
+			return err
+		}
+		fmt.Printf("Kept %d filtered alerts in %s, %s is unchanged\n", p.matched, p.filtered.TempPath(), p.filtered.Path())
+		return nil
+	}
+	if err := p.filtered.Finalize(); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %d filtered alerts to %s\n", p.matched, p.filtered.Path())
+	return nil
+}
+
+func (p *Pipeline) Matches() []Alert {
+	return p.matches
+}
+
+// Refused lists the matches kept from closing by closeRefusal.
+func (p *Pipeline) Refused() []CloseEntry {
+	return p.refused
+}
+
+// AlreadyClosed lists the matches skipped by SkipClosed.
+func (p *Pipeline) AlreadyClosed() []CloseEntry {
+	return p.skipped
+}
+
+// alertMark is where a match to close sits in the incremental window.
+type alertMark struct {
+	tenant string
+	at     time.Time
+}
+
+func (p *Pipeline) track(alert Alert) {
+	at, ok := alertTimestamp(alert)
+	if !ok {
+		return
+	}
+	if p.pending == nil {
+		p.pending = make(map[string]alertMark)
+	}
+	p.pending[alert.InternalID] = alertMark{tenant: alert.TenantID, at: at}
+}
+
+// HoldBack returns, per tenant, the time of the oldest match that summary
+// reports failed or not attempted: the high-water mark must not pass it, so
+// the next run fetches it again. Matches refused by closeRefusal are left
+// open on purpose and do not hold the mark back.
+func (p *Pipeline) HoldBack(summary CloseSummary) map[string]time.Time {
+	hold := make(map[string]time.Time)
+	for _, entries := range [][]CloseEntry{summary.Failed, summary.NotAttempted} {
+		for _, entry := range entries {
+			mark, ok := p.pending[entry.ID]
+			if !ok {
+				continue
+			}
+			if h, ok := hold[mark.tenant]; !ok || mark.at.Before(h) {
+				hold[mark.tenant] = mark.at
+			}
+		}
+	}
+	return hold
+}
+
+// Scanned is the number of alerts that went through the filters.
+func (p *Pipeline) Scanned() int {
+	return p.scanned
+}
+
+func (p *Pipeline) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// slimAlert drops the bulky parts of an alert that closing does not need.
+func slimAlert(alert Alert) Alert {
+	alert.OriginalEvents = nil
+	alert.HistoryRecords = nil
+	alert.Extra = nil
+	alert.Assets = nil
+	return alert
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointLimiter is a token bucket for one API endpoint. When adaptive is
+// set it also caps the number of in-flight requests, halving the cap on
+// 429/503 or latency spikes and raising it by one after a full window of
+// healthy responses.
+type EndpointLimiter struct {
+	mu          sync.Mutex
+	changed     chan struct{}
+	name        string
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	adaptive    bool
+	limit       int
+	maxLimit    int
+	inFlight    int
+	successes   int
+	baseline    time.Duration
+	debug       bool
+}
+
+func NewEndpointLimiter(name string, rate float64, maxLimit int, adaptive bool, debug bool) *EndpointLimiter {
+	if maxLimit < 1 {
+		maxLimit = 1
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	l := &EndpointLimiter{
+		name:     name,
+		rate:     rate,
+		burst:    burst,
+		tokens:   burst,
+		last:     time.Now(),
+		adaptive: adaptive,
+		limit:    maxLimit,
+		maxLimit: maxLimit,
+		debug:    debug,
+		changed:  make(chan struct{}),
+	}
+	return l
+}
+
+// Acquire waits for an in-flight slot and a token. It returns the error of
+// ctx, without holding a slot, if ctx is done first.
+func (l *EndpointLimiter) Acquire(ctx context.Context) error {
+	l.mu.Lock()
+	for l.adaptive && l.inFlight >= l.limit {
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	l.inFlight++
+	l.mu.Unlock()
+
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		if now.Before(l.pausedUntil) {
+			wait := l.pausedUntil.Sub(now)
+			l.mu.Unlock()
+			if !sleepCtx(ctx, wait) {
+				l.cancel()
+				return ctx.Err()
+			}
+			continue
+		}
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+		if !sleepCtx(ctx, wait) {
+			l.cancel()
+			return ctx.Err()
+		}
+	}
+}
+
+// cancel frees the slot of an Acquire given up before sending.
+func (l *EndpointLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.wake()
+}
+
+// wake unblocks the Acquire calls waiting for a slot. l.mu must be held.
+func (l *EndpointLimiter) wake() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Release frees the in-flight slot and feeds the response back into the
+// adaptive controller. status is 0 when the request failed at transport level.
+func (l *EndpointLimiter) Release(status int, latency time.Duration, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer l.wake()
+
+	l.inFlight--
+	if retryAfter > 0 {
+		until := time.Now().Add(retryAfter)
+		if until.After(l.pausedUntil) {
+			l.pausedUntil = until
+		}
+	}
+	if !l.adaptive {
+		return
+	}
+
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		l.decrease(fmt.Sprintf("HTTP %d", status))
+		return
+	}
+	if status == 0 || status >= 500 {
+		return
+	}
+
+	if l.baseline == 0 {
+		l.baseline = latency
+	}
+	if latency > 2*l.baseline {
+		l.decrease(fmt.Sprintf("latency %s > 2x baseline %s", latency.Round(time.Millisecond), l.baseline.Round(time.Millisecond)))
+	} else {
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.maxLimit {
+			l.limit++
+			l.successes = 0
+		}
+	}
+	l.baseline = (l.baseline*15 + latency) / 16
+}
+
+func (l *EndpointLimiter) decrease(reason string) {
+	l.successes = 0
+	if l.limit <= 1 {
+		return
+	}
+	l.limit /= 2
+	if l.limit < 1 {
+		l.limit = 1
+	}
+	if l.debug {
+		fmt.Printf("Throttling %s: concurrency reduced to %d (%s)\n", l.name, l.limit, reason)
+	}
+}
+
+func (l *EndpointLimiter) CurrentLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// LimitedTransport rate limits outgoing requests per URL path.
+type LimitedTransport struct {
+	base      http.RoundTripper
+	mu        sync.Mutex
+	endpoints map[string]*EndpointLimiter
+	rate      float64
+	rates     map[string]float64
+	maxLimit  int
+	adaptive  bool
+	debug     bool
+}
+
+func NewLimitedTransport(base http.RoundTripper, config JsonConfig) *LimitedTransport {
+	return &LimitedTransport{
+		base:      base,
+		endpoints: make(map[string]*EndpointLimiter),
+		rate:      config.RequestsPerSecond,
+		rates:     config.RateLimits,
+		maxLimit:  config.MaxConcurrentPages,
+		adaptive:  config.AdaptiveConcurrency,
+		debug:     config.Debug,
+	}
+}
+
+func (t *LimitedTransport) limiterFor(path string) *EndpointLimiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if l, ok := t.endpoints[path]; ok {
+		return l
+	}
+	rate := t.rate
+	for suffix, r := range t.rates {
+		if strings.HasSuffix(path, "/"+strings.Trim(suffix, "/")) {
+			rate = r
+			break
+		}
+	}
+	l := NewEndpointLimiter(path, rate, t.maxLimit, t.adaptive, t.debug)
+	t.endpoints[path] = l
+	return l
+}
+
+func (t *LimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	l := t.limiterFor(req.URL.Path)
+	if err := l.Acquire(req.Context()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		l.Release(0, latency, 0)
+		return nil, err
+	}
+
+	retryAfter := time.Duration(0)
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+
+	// Keep the slot until the body has been consumed: large pages with
+	// events take most of their time streaming.
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() {
+		l.Release(resp.StatusCode, latency, retryAfter)
+	}}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
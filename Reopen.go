@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ReopenTargets reads the audit log and returns the alerts to reopen: those
+// successfully closed by runID, or whose InternalID is in ids, and not
+// reopened since. Each target carries the status it had before the close.
+// The ids not found among the closed alerts are returned apart.
+func ReopenTargets(auditPath string, runID string, ids []string) ([]Alert, []string, error) {
+	wanted := make(map[string]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	closed := make(map[string]AuditEntry)
+	var order []string
+	err := ReadAuditLog(auditPath, func(line int, entry AuditEntry) error {
+		if !entry.Success {
+			return nil
+		}
+		switch entry.Action {
+		case "close":
+			if runID != "" && entry.RunID != runID {
+				return nil
+			}
+			if runID == "" && !wanted[entry.AlertID] {
+				return nil
+			}
+			if _, ok := closed[entry.AlertID]; !ok {
+				order = append(order, entry.AlertID)
+			}
+			closed[entry.AlertID] = entry
+		case "reopen":
+			delete(closed, entry.AlertID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var targets []Alert
+	for _, id := range order {
+		entry, ok := closed[id]
+		if !ok {
+			continue
+		}
+		targets = append(targets, Alert{
+			InternalID: entry.AlertID,
+			Name:       entry.AlertName,
+			TenantID:   entry.TenantID,
+			Status:     entry.PreviousStatus,
+		})
+	}
+
+	var missing []string
+	for id := range wanted {
+		if _, ok := closed[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	return targets, missing, nil
+}
+
+// reopenAlert sets alert back to alert.Status, the status it had before it
+// was closed.
+func reopenAlert(ctx context.Context, alert Alert, config JsonConfig, client *http.Client, audit *AuditLog) CloseResult {
+	reopenReq := StatusRequest{
+		ID:       alert.InternalID,
+		TenantID: alert.TenantID,
+		Status:   alert.Status,
+	}
+	entry := AuditEntry{
+		Action:         "reopen",
+		PreviousStatus: "closed",
+		NewStatus:      alert.Status,
+	}
+	return postAlertRequest(ctx, alert, alertURL(config, "status", alert), reopenReq, entry, defaultRetry(config), config, client, audit)
+}
+
+// runReopen reverts alerts closed by a run, or given by InternalID, to their
+// previous status using the close audit log:
+//
+//	xdr-cleaner reopen -run 20261019T101500Z-3f9a1c2e -dry-run
+//	xdr-cleaner reopen -ids id1,id2
+func runReopen(config JsonConfig, args []string) int {
+	fs := flag.NewFlagSet("reopen", flag.ContinueOnError)
+	runID := fs.String("run", "", "reopen the alerts closed by this run ID")
+	idList := fs.String("ids", "", "comma separated InternalIDs to reopen")
+	auditPath := fs.String("log", config.AuditLog, "close audit log")
+	dryRun := fs.Bool("dry-run", false, "list the alerts without reopening them")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if (*runID == "") == (*idList == "") {
+		fmt.Println("ERROR: reopen needs either -run or -ids")
+		return 1
+	}
+	var ids []string
+	for _, id := range strings.Split(*idList, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	targets, missing, err := ReopenTargets(*auditPath, *runID, ids)
+	if err != nil {
+		fmt.Println("AUDIT ERROR:", err)
+		return 1
+	}
+	for _, id := range missing {
+		fmt.Printf("WARNING: %s has no successful close in %s, skipped\n", id, *auditPath)
+	}
+	if len(targets) == 0 {
+		fmt.Println("No alerts to reopen")
+		return 0
+	}
+
+	if *dryRun {
+		for _, alert := range targets {
+			fmt.Printf("Would reopen %s (%s) to status %q\n", alert.InternalID, alert.Name, alert.Status)
+		}
+		fmt.Printf("Dry run: %d alerts would be reopened\n", len(targets))
+		return 0
+	}
+
+	if config.Token == "" || len(config.BaseURL) < 3 {
+		fmt.Println("ERROR: token and URL are required to reopen alerts")
+		return 1
+	}
+	if _, err := CloseRetry(config); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	run := NewRun(config)
+	audit, err := OpenAuditLog(*auditPath, config.AuditHashChain, run.Metadata.RunID)
+	if err != nil {
+		fmt.Println("AUDIT ERROR:", err)
+		return 1
+	}
+	defer audit.Close()
+
+	client := BuilClient(config)
+	ctx, stop := interruptContext()
+	defer stop()
+
+	fmt.Printf("Reopening %d alerts...\n", len(targets))
+	q := startQueue(ctx, config, audit, "Reopen", "Reopened", func(alert Alert) CloseResult {
+		return reopenAlert(ctx, alert, config, client, audit)
+	}, nil)
+	for _, alert := range targets {
+		if alert.Status == "" {
+			q.results <- failedResult(alert, fmt.Errorf("previous status unknown"))
+			continue
+		}
+		q.Add(alert)
+	}
+	summary := q.Wait()
+
+	if summary.AuditError != "" {
+		return 1
+	}
+	if summary.Interrupted {
+		return 130
+	}
+	if len(summary.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Version is set at build time with -ldflags "-X main.Version=1.2.3".
+var Version = "dev"
+
+// Run holds the provenance of one execution, written at the head of every
+// output file and in the close summary, and its result once fetching is
+// over.
+type Run struct {
+	Metadata RunMetadata
+	Result   *RunResult
+}
+
+type RunMetadata struct {
+	RunID         string        `json:"runID"`
+	Tool          string        `json:"tool"`
+	Version       string        `json:"version"`
+	StartedAt     string        `json:"startedAt"`
+	TenantID      string        `json:"tenantID"`
+	BaseURL       string        `json:"baseURL"`
+	Source        string        `json:"source,omitempty"`
+	Query         QueryParams   `json:"query"`
+	FetchStrategy string        `json:"fetchStrategy"`
+	Incremental   bool          `json:"incremental,omitempty"`
+	FilterMode    bool          `json:"filterMode"`
+	FiltersHash   string        `json:"filtersHash,omitempty"`
+	Filters       []Filter      `json:"filters,omitempty"`
+	Suppressions  []Suppression `json:"suppressions,omitempty"`
+}
+
+// RunResult is written at the end of the output documents and in the close
+// summary. Written is the number of alerts in the file it ends, or in all
+// chunks in a manifest; it is zero in the close summary.
+type RunResult struct {
+	RunID       string `json:"runID"`
+	FinishedAt  string `json:"finishedAt"`
+	Pages       int    `json:"pages"`
+	Alerts      int    `json:"alerts"`
+	Duplicates  int    `json:"duplicates"`
+	FailedPages int    `json:"failedPages"`
+	Complete    bool   `json:"complete"`
+	Interrupted bool   `json:"interrupted,omitempty"`
+	Written     int    `json:"written"`
+}
+
+func NewRun(config JsonConfig) *Run {
+	now := time.Now().UTC()
+	meta := RunMetadata{
+		RunID:         NewRunID(now),
+		Tool:          "xdr-cleaner",
+		Version:       Version,
+		StartedAt:     now.Format(time.RFC3339),
+		TenantID:      config.TenantID,
+		BaseURL:       config.BaseURL,
+		Query:         queryParams(config),
+		FetchStrategy: config.FetchStrategy,
+		Incremental:   config.Incremental,
+		FilterMode:    config.FilterMode,
+	}
+	if config.FilterMode {
+		meta.Filters = config.Filters
+		meta.Suppressions = config.Suppressions
+		meta.FiltersHash = FiltersHash(config.Filters, config.Suppressions)
+	}
+	return &Run{Metadata: meta}
+}
+
+// NewRunID returns a sortable, unique run identifier such as
+// 20261019T101500Z-3f9a1c2e.
+func NewRunID(t time.Time) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return t.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+// FiltersHash identifies a set of filters and suppressions; without
+// suppressions it is the hash of the filters alone.
+func FiltersHash(filters []Filter, suppressions []Suppression) string {
+	data, _ := json.Marshal(filters)
+	if len(suppressions) > 0 {
+		more, _ := json.Marshal(suppressions)
+		data = append(data, more...)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// QueryParams maps query parameters to all their values.
+type QueryParams map[string][]string
+
+// queryParams returns the parameters BuildURL sends, without the page.
+func queryParams(config JsonConfig) QueryParams {
+	params := make(QueryParams)
+	u, err := url.Parse(BuildURL(config, 0))
+	if err != nil {
+		return params
+	}
+	for key, values := range u.Query() {
+		if key != "page" {
+			params[key] = values
+		}
+	}
+	return params
+}
+
+// Finish records the outcome of fetching.
+func (r *Run) Finish(report FetchReport) {
+	r.Result = &RunResult{
+		RunID:       r.Metadata.RunID,
+		FinishedAt:  time.Now().UTC().Format(time.RFC3339),
+		Pages:       report.Pages,
+		Alerts:      report.Alerts,
+		Duplicates:  report.Duplicates,
+		FailedPages: len(report.Gaps),
+		Complete:    report.Complete(),
+		Interrupted: report.Interrupted,
+	}
+}
+
+// documentHead opens a {"Metadata": ..., "Alerts": [ document.
+func (r *Run) documentHead() (string, error) {
+	if r == nil {
+		return "{\n  \"Alerts\": [\n", nil
+	}
+	meta, err := json.MarshalIndent(r.Metadata, "  ", "  ")
+	if err != nil {
+		return "", fmt.Errorf("metadata marshal error: %w", err)
+	}
+	return "{\n  \"Metadata\": " + string(meta) + ",\n  \"Alerts\": [\n", nil
+}
+
+// documentTail closes the Alerts array, followed by the result when known.
+func (r *Run) documentTail(written int) (string, error) {
+	if r == nil || r.Result == nil {
+		return "\n  ]\n}\n", nil
+	}
+	result := *r.Result
+	result.Written = written
+	data, err := json.MarshalIndent(result, "  ", "  ")
+	if err != nil {
+		return "", fmt.Errorf("result marshal error: %w", err)
+	}
+	return "\n  ],\n  \"Result\": " + string(data) + "\n}\n", nil
+}
+
+// RunRecord holds the run metadata and result of an NDJSON output, whose
+// lines are all alerts, in the file named by MetadataPath.
+type RunRecord struct {
+	Metadata *RunMetadata `json:"Metadata"`
+	Result   *RunResult   `json:"Result,omitempty"`
+}
+
+// MetadataPath is the RunRecord file of the NDJSON output filename.
+func MetadataPath(filename string) string {
+	return filename + ".meta.json"
+}
+
+// record is the RunRecord of an output of written alerts.
+func (r *Run) record(written int) RunRecord {
+	record := RunRecord{Metadata: &r.Metadata}
+	if r.Result != nil {
+		result := *r.Result
+		result.Written = written
+		record.Result = &result
+	}
+	return record
+}
+
+// SaveRecord writes the RunRecord of an output of written alerts.
+func (r *Run) SaveRecord(written int, filename string) error {
+	data, err := json.MarshalIndent(r.record(written), "", "  ")
+	if err != nil {
+		return fmt.Errorf("metadata marshal error: %w", err)
+	}
+	if err := FilePutContentsAtomic(filename, data); err != nil {
+		return fmt.Errorf("metadata write error: %w", err)
+	}
+	return nil
+}
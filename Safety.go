@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/term"
+)
+
+// severityRanks orders the alert severities for maxCloseSeverity.
+var severityRanks = map[string]int{
+	"info":          0,
+	"informational": 0,
+	"low":           1,
+	"medium":        2,
+	"high":          3,
+	"critical":      4,
+}
+
+// CheckCloseSeverity validates maxCloseSeverity: a known severity, or "any"
+// to close alerts whatever their severity.
+func CheckCloseSeverity(config JsonConfig) error {
+	if config.MaxCloseSeverity == "any" {
+		return nil
+	}
+	if _, ok := severityRanks[strings.ToLower(config.MaxCloseSeverity)]; !ok {
+		return fmt.Errorf("unknown maxCloseSeverity %q", config.MaxCloseSeverity)
+	}
+	return nil
+}
+
+// closeRefusal returns why alert must not be closed, or "" when it may be.
+// Alerts of an unknown severity are refused unless maxCloseSeverity is "any".
+// Other actions than close are not restricted.
+func closeRefusal(alert Alert, config JsonConfig) string {
+	if alertRule(alert, config).Action != "close" {
+		return ""
+	}
+	if alert.IsCII && !config.AllowCloseCII {
+		return "IsCII is set (allowCloseCII is false)"
+	}
+	if config.MaxCloseSeverity == "any" {
+		return ""
+	}
+	rank, ok := severityRanks[strings.ToLower(alert.Severity)]
+	if !ok {
+		return fmt.Sprintf("unknown severity %q", alert.Severity)
+	}
+	if rank > severityRanks[strings.ToLower(config.MaxCloseSeverity)] {
+		return fmt.Sprintf("severity %s is above maxCloseSeverity %s", alert.Severity, config.MaxCloseSeverity)
+	}
+	return ""
+}
+
+// checkCloseLimits refuses to close the alerts whose action is close when
+// they exceed maxCloseCount, or maxClosePercent of the scanned alerts.
+// Other actions are not counted.
+func checkCloseLimits(config JsonConfig, alerts []Alert, scanned int) error {
+	count := 0
+	for _, alert := range alerts {
+		if alertRule(alert, config).Action == "close" {
+			count++
+		}
+	}
+	if config.MaxCloseCount > 0 && count > config.MaxCloseCount {
+		return fmt.Errorf("%d alerts to close, maxCloseCount is %d", count, config.MaxCloseCount)
+	}
+	if config.MaxClosePercent > 0 && scanned > 0 {
+		percent := float64(count) * 100 / float64(scanned)
+		if percent > config.MaxClosePercent {
+			return fmt.Errorf("%d alerts to close out of %d (%.1f%%), maxClosePercent is %.1f%%", count, scanned, percent, config.MaxClosePercent)
+		}
+	}
+	return nil
+}
+
+// needsAllMatches reports whether closing must wait for the complete list
+// of matches, to check the limits or ask for confirmation.
+func needsAllMatches(config JsonConfig) bool {
+	return config.MaxCloseCount > 0 || config.MaxClosePercent > 0 || interactive(config)
+}
+
+// interactive reports whether closes are confirmed at a prompt: stdin is a
+// terminal and the run is not a daemon.
+func interactive(config JsonConfig) bool {
+	if config.SkipCloseConfirm || config.Daemon {
+		return false
+	}
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// confirmClose prints the alerts per suppression and action and asks for a
+// yes. An interrupt while waiting counts as a no.
+func confirmClose(ctx context.Context, alerts []Alert, config JsonConfig) bool {
+	type group struct{ suppression, action string }
+	counts := make(map[group]int)
+	closes := 0
+	for _, alert := range alerts {
+		rule := alertRule(alert, config)
+		counts[group{rule.Name, rule.Action}]++
+		if rule.Action == "close" {
+			closes++
+		}
+	}
+	groups := make([]group, 0, len(counts))
+	for g := range counts {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if counts[groups[i]] != counts[groups[j]] {
+			return counts[groups[i]] > counts[groups[j]]
+		}
+		if groups[i].suppression != groups[j].suppression {
+			return groups[i].suppression < groups[j].suppression
+		}
+		return groups[i].action < groups[j].action
+	})
+
+	if closes == len(alerts) {
+		fmt.Printf("\n%d alerts are about to be closed:\n", len(alerts))
+	} else {
+		fmt.Printf("\n%d alerts are about to be changed, %d of them closed:\n", len(alerts), closes)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  ALERTS\tACTION\tSUPPRESSION")
+	for _, g := range groups {
+		fmt.Fprintf(w, "  %d\t%s\t%s\n", counts[g], g.action, g.suppression)
+	}
+	w.Flush()
+	if closes == len(alerts) {
+		fmt.Print("Close them? [y/N] ")
+	} else {
+		fmt.Print("Proceed? [y/N] ")
+	}
+
+	answer := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer <- line
+	}()
+	select {
+	case line := <-answer:
+		line = strings.ToLower(strings.TrimSpace(line))
+		return line == "y" || line == "yes"
+	case <-ctx.Done():
+		fmt.Println()
+		return false
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Manifest lists the chunk files of a split output in order. Each chunk is a
+// standalone document of the output format.
+type Manifest struct {
+	Format      string          `json:"format"`
+	Compression string          `json:"compression,omitempty"`
+	Total       int             `json:"total"`
+	Chunks      []ManifestChunk `json:"chunks"`
+	Metadata    *RunMetadata    `json:"metadata,omitempty"`
+	Result      *RunResult      `json:"result,omitempty"`
+}
+
+type ManifestChunk struct {
+	File   string `json:"file"`
+	Alerts int    `json:"alerts"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// splitName cuts the base name of filename at its first dot, so that
+// "out.json.gz" gives "out" and ".json.gz".
+func splitName(filename string) (string, string) {
+	dir, base := filepath.Split(filename)
+	start := 0
+	if strings.HasPrefix(base, ".") {
+		start = 1
+	}
+	if i := strings.Index(base[start:], "."); i >= 0 {
+		i += start
+		return dir + base[:i], base[i:]
+	}
+	return filename, ""
+}
+
+// ChunkName returns the name of chunk n of filename: out.log gives
+// out.001.log, out.002.log...
+func ChunkName(filename string, n int) string {
+	stem, ext := splitName(filename)
+	return fmt.Sprintf("%s.%03d%s", stem, n, ext)
+}
+
+// ManifestPath returns the manifest of a split filename, named after its
+// full base name: out.json.gz gives out.json.gz.manifest.json.
+func ManifestPath(filename string) string {
+	return filename + ".manifest.json"
+}
+
+func isManifest(filename string) bool {
+	return strings.HasSuffix(filename, ".manifest.json")
+}
+
+func SaveManifest(manifest Manifest, filename string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("manifest marshal error: %w", err)
+	}
+	if err := FilePutContentsAtomic(filename, data); err != nil {
+		return fmt.Errorf("manifest write error: %w", err)
+	}
+	return nil
+}
+
+func LoadManifest(filename string) (Manifest, error) {
+	var manifest Manifest
+	data, err := fileGetContentsBytes(filename)
+	if err != nil {
+		return manifest, fmt.Errorf("manifest read error: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("manifest JSON error: %w", err)
+	}
+	return manifest, nil
+}
+
+// chunkFiles returns the paths of the chunks listed in a manifest; chunk
+// names are relative to the manifest.
+func chunkFiles(filename string) ([]string, error) {
+	manifest, err := LoadManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filename)
+	files := make([]string, 0, len(manifest.Chunks))
+	for _, chunk := range manifest.Chunks {
+		files = append(files, filepath.Join(dir, chunk.File))
+	}
+	return files, nil
+}
+
+func fileChecksum(filename string) (string, int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// RunState is persisted between runs so that incremental mode only fetches
+// alerts created or updated since the last successful run.
+type RunState struct {
+	Tenants map[string]TenantState `json:"tenants"`
+}
+
+type TenantState struct {
+	HighWater string `json:"highWater"`
+	LastRun   string `json:"lastRun"`
+}
+
+func LoadState(path string) (RunState, error) {
+	state := RunState{Tenants: make(map[string]TenantState)}
+	if !FileExists(path) {
+		return state, nil
+	}
+	data, err := fileGetContentsBytes(path)
+	if err != nil {
+		return state, fmt.Errorf("read state error: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("parse state error: %w", err)
+	}
+	if state.Tenants == nil {
+		state.Tenants = make(map[string]TenantState)
+	}
+	return state, nil
+}
+
+func (s RunState) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return fmt.Errorf("marshal state error: %w", err)
+	}
+	if err := FilePutContentsAtomic(path, data); err != nil {
+		return fmt.Errorf("write state error: %w", err)
+	}
+	return nil
+}
+
+// Advance records the high-water marks of a complete run. A mark is never
+// later than runAt, in case the API returned alerts beyond the window, nor
+// than the hold of its tenant, the oldest match the run left open.
+func (s RunState) Advance(highWater map[string]time.Time, hold map[string]time.Time, runAt time.Time) {
+	for tenant, hw := range highWater {
+		if hw.After(runAt) {
+			hw = runAt
+		}
+		if h, ok := hold[tenant]; ok && h.Before(hw) {
+			hw = h
+		}
+		ts := s.Tenants[tenant]
+		if prev, err := time.Parse(time.RFC3339Nano, ts.HighWater); err != nil || hw.After(prev) {
+			ts.HighWater = hw.UTC().Format(time.RFC3339Nano)
+		}
+		ts.LastRun = runAt.UTC().Format(time.RFC3339)
+		s.Tenants[tenant] = ts
+	}
+}
+
+// FromDate returns the lower bound to query for tenant: the stored
+// high-water mark, or fromDate when it is later or no mark exists.
+func (s RunState) FromDate(tenant string, fromDate string) string {
+	hw, err := time.Parse(time.RFC3339Nano, s.Tenants[tenant].HighWater)
+	if err != nil {
+		return fromDate
+	}
+	if from, err := time.Parse(time.RFC3339, fromDate); err == nil && from.After(hw) {
+		return fromDate
+	}
+	return hw.UTC().Format(time.RFC3339)
+}
+
+// windowEnd returns the upper bound to query in incremental mode: toDate
+// when it is earlier than runAt, else runAt.
+func windowEnd(toDate string, runAt time.Time) string {
+	if to, err := time.Parse(time.RFC3339, toDate); err == nil && to.Before(runAt) {
+		return toDate
+	}
+	return runAt.UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+// alertTimestamp is the time an alert was last changed.
+func alertTimestamp(alert Alert) (time.Time, bool) {
+	for _, value := range []string{alert.UpdatedAt, alert.CreatedAt} {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
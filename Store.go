@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// AlertStore persists fetched alerts in a local SQLite database, one row per
+// InternalID updated on every run, with their observables, rules and base
+// events in side tables and a history row whenever the status changes.
+type AlertStore struct {
+	db *sql.DB
+}
+
+const storeSchema = `
+CREATE TABLE IF NOT EXISTS alerts (
+	internal_id       TEXT PRIMARY KEY,
+	id                INTEGER,
+	tenant_id         TEXT,
+	name              TEXT,
+	severity          TEXT,
+	status            TEXT,
+	status_resolution TEXT,
+	incident_id       TEXT,
+	external_ref      TEXT,
+	assignee          TEXT,
+	is_cii            INTEGER,
+	created_at        TEXT,
+	updated_at        TEXT,
+	first_event_time  TEXT,
+	last_event_time   TEXT,
+	first_seen        TEXT,
+	last_seen         TEXT,
+	data              TEXT
+);
+CREATE INDEX IF NOT EXISTS alerts_tenant ON alerts (tenant_id);
+CREATE INDEX IF NOT EXISTS alerts_status ON alerts (status);
+CREATE TABLE IF NOT EXISTS observables (
+	internal_id TEXT,
+	type        TEXT,
+	value       TEXT,
+	details     TEXT
+);
+CREATE INDEX IF NOT EXISTS observables_alert ON observables (internal_id);
+CREATE INDEX IF NOT EXISTS observables_value ON observables (value);
+CREATE TABLE IF NOT EXISTS rules (
+	internal_id TEXT,
+	rule_id     TEXT,
+	name        TEXT,
+	type        TEXT,
+	severity    TEXT,
+	confidence  TEXT
+);
+CREATE INDEX IF NOT EXISTS rules_alert ON rules (internal_id);
+CREATE INDEX IF NOT EXISTS rules_name ON rules (name);
+CREATE TABLE IF NOT EXISTS base_events (
+	internal_id          TEXT,
+	event_id             TEXT,
+	name                 TEXT,
+	message              TEXT,
+	timestamp            INTEGER,
+	source_address       TEXT,
+	source_port          INTEGER,
+	destination_address  TEXT,
+	destination_port     INTEGER,
+	device_address       TEXT,
+	device_host_name     TEXT,
+	device_action        TEXT,
+	device_vendor        TEXT,
+	device_product       TEXT,
+	transport_protocol   TEXT,
+	application_protocol TEXT
+);
+CREATE INDEX IF NOT EXISTS base_events_alert ON base_events (internal_id);
+CREATE TABLE IF NOT EXISTS alert_history (
+	internal_id       TEXT,
+	seen_at           TEXT,
+	status            TEXT,
+	status_resolution TEXT,
+	updated_at        TEXT
+);
+CREATE INDEX IF NOT EXISTS alert_history_alert ON alert_history (internal_id);
+`
+
+// OpenStore opens (or creates) the SQLite database at path.
+func OpenStore(path string) (*AlertStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("store open error: %w", err)
+	}
+	// A single connection serializes the writers of a run.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(storeSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("store schema error: %w", err)
+	}
+	return &AlertStore{db: db}, nil
+}
+
+func (s *AlertStore) Close() error {
+	return s.db.Close()
+}
+
+// Upsert stores alerts in one transaction. Alerts without an InternalID
+// cannot be tracked across runs and are skipped.
+func (s *AlertStore) Upsert(alerts []Alert, seenAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("store error: %w", err)
+	}
+	defer tx.Rollback()
+
+	seen := seenAt.UTC().Format(time.RFC3339)
+	for _, alert := range alerts {
+		if alert.InternalID == "" {
+			continue
+		}
+		if err := upsertAlert(tx, alert, seen); err != nil {
+			return fmt.Errorf("store error on %s: %w", alert.InternalID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("store commit error: %w", err)
+	}
+	return nil
+}
+
+func upsertAlert(tx *sql.Tx, alert Alert, seen string) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	var status, resolution, updatedAt string
+	err = tx.QueryRow(`SELECT status, status_resolution, updated_at FROM alerts WHERE internal_id = ?`, alert.InternalID).
+		Scan(&status, &resolution, &updatedAt)
+	changed := err == sql.ErrNoRows ||
+		status != alert.Status || resolution != alert.StatusResolution || updatedAt != alert.UpdatedAt
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO alerts (internal_id, id, tenant_id, name, severity, status, status_resolution,
+		incident_id, external_ref, assignee, is_cii, created_at, updated_at, first_event_time, last_event_time,
+		first_seen, last_seen, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (internal_id) DO UPDATE SET
+			id = excluded.id, tenant_id = excluded.tenant_id, name = excluded.name,
+			severity = excluded.severity, status = excluded.status,
+			status_resolution = excluded.status_resolution, incident_id = excluded.incident_id,
+			external_ref = excluded.external_ref, assignee = excluded.assignee, is_cii = excluded.is_cii,
+			created_at = excluded.created_at, updated_at = excluded.updated_at,
+			first_event_time = excluded.first_event_time, last_event_time = excluded.last_event_time,
+			last_seen = excluded.last_seen, data = excluded.data`,
+		alert.InternalID, alert.ID, alert.TenantID, alert.Name, alert.Severity, alert.Status, alert.StatusResolution,
+		alert.IncidentID, alert.ExternalRef, alert.Assignee.Name, alert.IsCII, alert.CreatedAt, alert.UpdatedAt,
+		alert.FirstEventTime, alert.LastEventTime, seen, seen, string(data))
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		_, err = tx.Exec(`INSERT INTO alert_history (internal_id, seen_at, status, status_resolution, updated_at) VALUES (?, ?, ?, ?, ?)`,
+			alert.InternalID, seen, alert.Status, alert.StatusResolution, alert.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{"observables", "rules", "base_events"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE internal_id = ?`, alert.InternalID); err != nil {
+			return err
+		}
+	}
+	for _, obs := range alert.Observables {
+		_, err := tx.Exec(`INSERT INTO observables (internal_id, type, value, details) VALUES (?, ?, ?, ?)`,
+			alert.InternalID, obs.Type, obs.Value, obs.Details)
+		if err != nil {
+			return err
+		}
+	}
+	for _, rule := range alert.Rules {
+		_, err := tx.Exec(`INSERT INTO rules (internal_id, rule_id, name, type, severity, confidence) VALUES (?, ?, ?, ?, ?, ?)`,
+			alert.InternalID, rule.ID, rule.Name, rule.Type, rule.Severity, rule.Confidence)
+		if err != nil {
+			return err
+		}
+	}
+	for _, event := range alert.OriginalEvents {
+		for _, be := range event.BaseEvents {
+			_, err := tx.Exec(`INSERT INTO base_events (internal_id, event_id, name, message, timestamp,
+				source_address, source_port, destination_address, destination_port, device_address,
+				device_host_name, device_action, device_vendor, device_product, transport_protocol,
+				application_protocol) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				alert.InternalID, be.ID, be.Name, be.Message, be.Timestamp,
+				be.SourceAddress, be.SourcePort, be.DestinationAddress, be.DestinationPort, be.DeviceAddress,
+				be.DeviceHostName, be.DeviceAction, be.DeviceVendor, be.DeviceProduct, be.TransportProtocol,
+				be.ApplicationProtocol)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Each passes the stored alerts matching the SQL condition where (on the
+// alerts table, empty for all) to fn, one at a time.
+func (s *AlertStore) Each(where string, fn func(Alert) error) error {
+	query := `SELECT data FROM alerts`
+	if strings.TrimSpace(where) != "" {
+		query += ` WHERE ` + where
+	}
+	rows, err := s.db.Query(query + ` ORDER BY created_at, internal_id`)
+	if err != nil {
+		return fmt.Errorf("store query error: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return fmt.Errorf("store query error: %w", err)
+		}
+		var alert Alert
+		if err := json.Unmarshal([]byte(data), &alert); err != nil {
+			return fmt.Errorf("store JSON error: %w", err)
+		}
+		if err := fn(alert); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Query runs a SQL query and prints its rows as aligned columns.
+func (s *AlertStore) Query(query string, out io.Writer) (int, error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return 0, fmt.Errorf("store query error: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, fmt.Errorf("store query error: %w", err)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+
+	count := 0
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return count, fmt.Errorf("store query error: %w", err)
+		}
+		cells := make([]string, len(values))
+		for i, v := range values {
+			cells[i] = v.String
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("store query error: %w", err)
+	}
+	return count, w.Flush()
+}
+
+// runQuery runs a SQL query on the alert store:
+//
+//	xdr-cleaner query "SELECT value, count(*) FROM observables GROUP BY value"
+func runQuery(config JsonConfig, args []string) int {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	storeFile := fs.String("store", config.StoreFile, "SQLite alert store")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *storeFile == "" || fs.NArg() == 0 {
+		fmt.Println("ERROR: usage: query [-store file] \"SQL\" (storeFile is not set in config)")
+		return 1
+	}
+
+	store, err := OpenStore(*storeFile)
+	if err != nil {
+		fmt.Println("STORE ERROR:", err)
+		return 1
+	}
+	defer store.Close()
+
+	count, err := store.Query(strings.Join(fs.Args(), " "), os.Stdout)
+	if err != nil {
+		fmt.Println("QUERY ERROR:", err)
+		return 1
+	}
+	fmt.Printf("(%d rows)\n", count)
+	return 0
+}
+
+// runStoreFilter runs the filter and close stages on the alerts of the
+// store instead of fetching them again:
+//
+//	xdr-cleaner filter -where "status = 'open'"
+func runStoreFilter(config JsonConfig, args []string) int {
+	fs := flag.NewFlagSet("filter", flag.ContinueOnError)
+	storeFile := fs.String("store", config.StoreFile, "SQLite alert store")
+	where := fs.String("where", "", "SQL condition on the alerts table")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *storeFile == "" {
+		fmt.Println("ERROR: storeFile is not set in config")
+		return 1
+	}
+	if len(SuppressionRules(config)) == 0 {
+		fmt.Println("ERROR: no filters or suppressions in config")
+		return 1
+	}
+	if config.CloseAlerts && (config.Token == "" || len(config.BaseURL) < 3) {
+		fmt.Println("ERROR: token and URL are required to close alerts")
+		return 1
+	}
+	if err := CheckCloseSeverity(config); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	if err := CheckActions(config); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	if _, err := CloseRetry(config); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	if err := CheckCompression(config); err != nil {
+		fmt.Println("ERROR:", err)
+		return 1
+	}
+	config.FilterMode = true
+
+	store, err := OpenStore(*storeFile)
+	if err != nil {
+		fmt.Println("STORE ERROR:", err)
+		return 1
+	}
+	defer store.Close()
+
+	client := BuilClient(config)
+	ctx, stop := interruptContext()
+	defer stop()
+
+	run := NewRun(config)
+	run.Metadata.Source = *storeFile
+	pipeline := NewPipeline(config, run, nil)
+	audit, err := openAudit(config, run)
+	if err != nil {
+		fmt.Println("AUDIT ERROR:", err)
+		return 1
+	}
+	defer audit.Close()
+	if audit != nil {
+		closed, err := ClosedIDs(config.AuditLog)
+		if err != nil {
+			fmt.Println("AUDIT ERROR:", err)
+			return 1
+		}
+		pipeline.SkipClosed(closed)
+	}
+	if config.StreamClose {
+		pipeline.StreamClose(ctx, client, audit)
+	}
+	if err := pipeline.ReplayStore(store, *where); err != nil {
+		fmt.Println("STORE FILTER ERROR:", err)
+		return 1
+	}
+	if err := pipeline.Finalize(ctx.Err() == nil); err != nil {
+		fmt.Println("FILTER SAVE ERROR:", err)
+		return 1
+	}
+
+	_, closeErr := closeMatches(ctx, config, client, run, audit, pipeline, true)
+	if ctx.Err() != nil {
+		return 130
+	}
+	if closeErr != nil {
+		return 1
+	}
+	return 0
+}
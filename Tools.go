@@ -12,7 +12,12 @@ import (
 func BuildURL(TheConf JsonConfig, currentPage int) string {
 	params := url.Values{}
 	params.Set("page", fmt.Sprintf("%d", currentPage))
-	//params.Set("timestampField", *timestampField)
+	if TheConf.PageSize > 0 {
+		params.Set("pageSize", fmt.Sprintf("%d", TheConf.PageSize))
+	}
+	if TheConf.TimestampField != "" {
+		params.Set("timestampField", TheConf.TimestampField)
+	}
 
 	if TheConf.Ids != "" {
 		for _, v := range strings.Split(TheConf.Ids, ",") {
@@ -66,9 +71,12 @@ func BuildURL(TheConf JsonConfig, currentPage int) string {
 
 	return TheConf.BaseURL + "?" + params.Encode()
 }
-func BuilClient() *http.Client {
+func BuilClient(TheConf JsonConfig) *http.Client {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
-	return &http.Client{Transport: tr}
+	if TheConf.RequestsPerSecond <= 0 && len(TheConf.RateLimits) == 0 && !TheConf.AdaptiveConcurrency {
+		return &http.Client{Transport: tr}
+	}
+	return &http.Client{Transport: NewLimitedTransport(tr, TheConf)}
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type TimeWindow struct {
+	From time.Time
+	To   time.Time
+}
+
+func (w TimeWindow) String() string {
+	return w.From.Format(time.RFC3339) + "/" + w.To.Format(time.RFC3339)
+}
+
+// SplitWindows slices [from, to) into consecutive windows of size step.
+func SplitWindows(from, to time.Time, step time.Duration) []TimeWindow {
+	var windows []TimeWindow
+	for start := from; start.Before(to); start = start.Add(step) {
+		end := start.Add(step)
+		if end.After(to) {
+			end = to
+		}
+		windows = append(windows, TimeWindow{From: start, To: end})
+	}
+	return windows
+}
+
+// ParseWindows returns the time windows covering the configured period.
+func ParseWindows(config JsonConfig) ([]TimeWindow, error) {
+	from, err := time.Parse(time.RFC3339, config.FromDate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fromDate: %w", err)
+	}
+	to := time.Now().UTC()
+	if config.ToDate != "" {
+		to, err = time.Parse(time.RFC3339, config.ToDate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid toDate: %w", err)
+		}
+	}
+	step, err := time.ParseDuration(config.WindowSize)
+	if err != nil || step <= 0 {
+		return nil, fmt.Errorf("invalid windowSize: %s", config.WindowSize)
+	}
+	return SplitWindows(from, to, step), nil
+}
+
+// fetchWindows paginates each time window of [FromDate, ToDate) on its own,
+// MaxConcurrentWindows at a time. A small window holds few pages, so alerts
+// created or closed during the run shift far less of the result set than a
+// single pagination over the whole period.
+func fetchWindows(ctx context.Context, config JsonConfig, client *http.Client, cp *Checkpoint, handle func(PageResult)) FetchReport {
+	var report FetchReport
+
+	windows, err := ParseWindows(config)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		report.Aborted = true
+		return report
+	}
+	if config.Debug {
+		fmt.Printf("Fetching %d time windows of %s\n", len(windows), config.WindowSize)
+	}
+
+	// Share the page concurrency budget between the windows running at once.
+	windowConf := config
+	windowConf.MaxConcurrentPages = config.MaxConcurrentPages / config.MaxConcurrentWindows
+	if windowConf.MaxConcurrentPages < 1 {
+		windowConf.MaxConcurrentPages = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, config.MaxConcurrentWindows)
+
+	for _, window := range windows {
+		wg.Add(1)
+		go func(w TimeWindow) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-semaphore }()
+
+			conf := windowConf
+			conf.FromDate = w.From.Format(time.RFC3339)
+			conf.ToDate = w.To.Format(time.RFC3339)
+
+			windowReport := fetchPages(ctx, conf, client, cp, func(result PageResult) {
+				mu.Lock()
+				defer mu.Unlock()
+				handle(result)
+			})
+			for i := range windowReport.Gaps {
+				windowReport.Gaps[i].Window = w.String()
+			}
+
+			mu.Lock()
+			report.Merge(windowReport)
+			mu.Unlock()
+
+			if config.Debug {
+				fmt.Printf("Window %s completed: %d alerts\n", w, windowReport.Alerts)
+			}
+		}(window)
+	}
+
+	wg.Wait()
+	return report
+}
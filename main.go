@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 func main() {
@@ -14,6 +17,25 @@ func main() {
 	sPath := ConfigPath()
 	TheConf := LoadConfig()
 
+	// Offline commands work on existing dumps and need no API access
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			os.Exit(runExport(TheConf, os.Args[2:]))
+		case "query":
+			os.Exit(runQuery(TheConf, os.Args[2:]))
+		case "filter":
+			os.Exit(runStoreFilter(TheConf, os.Args[2:]))
+		case "reopen":
+			os.Exit(runReopen(TheConf, os.Args[2:]))
+		case "audit-verify":
+			os.Exit(runAuditVerify(TheConf, os.Args[2:]))
+		default:
+			fmt.Println("ERROR: unknown command:", os.Args[1])
+			os.Exit(1)
+		}
+	}
+
 	// Required args
 	if TheConf.TenantID == "" {
 		fmt.Println("ERROR: is required see:" + sPath)
@@ -27,56 +49,283 @@ func main() {
 		fmt.Println("ERROR: URL is required see:" + sPath)
 		os.Exit(1)
 	}
+	if err := CheckCloseSeverity(TheConf); err != nil {
+		fmt.Println("ERROR:", err, "see:"+sPath)
+		os.Exit(1)
+	}
+	if err := CheckActions(TheConf); err != nil {
+		fmt.Println("ERROR:", err, "see:"+sPath)
+		os.Exit(1)
+	}
+	if _, err := CloseRetry(TheConf); err != nil {
+		fmt.Println("ERROR:", err, "see:"+sPath)
+		os.Exit(1)
+	}
+	if err := CheckCompression(TheConf); err != nil {
+		fmt.Println("ERROR:", err, "see:"+sPath)
+		os.Exit(1)
+	}
+	if TheConf.FetchStrategy == "windows" {
+		if _, err := ParseWindows(TheConf); err != nil {
+			fmt.Println("ERROR: windows fetch strategy:", err, "see:"+sPath)
+			os.Exit(1)
+		}
+	}
 
 	if TheConf.Debug {
 		fmt.Println("Using token:", TheConf.Token)
 		fmt.Printf("Max concurrent pages: %d\n", TheConf.MaxConcurrentPages)
 		fmt.Printf("Flush every: %d alerts\n", TheConf.FlushEvery)
+		if TheConf.RequestsPerSecond > 0 {
+			fmt.Printf("Rate limit: %.2f requests/s per endpoint\n", TheConf.RequestsPerSecond)
+		}
+		if TheConf.AdaptiveConcurrency {
+			fmt.Println("Adaptive concurrency: enabled")
+		}
 	}
 
-	client := BuilClient()
+	client := BuilClient(TheConf)
+	ctx, stop := interruptContext()
+	defer stop()
 
-	flushMgr := NewFlushManager(TheConf.Outfile, TheConf.FlushEvery, TheConf.Debug)
-	allAlerts := fetchAllAlertsParallelWithFlush(TheConf, client, flushMgr)
+	code := 0
+	if TheConf.Daemon {
+		code = runDaemon(ctx, TheConf, client)
+	} else {
+		code = runOnce(ctx, TheConf, client)
+	}
+	stop()
+	os.Exit(code)
+}
+
+// runOnce fetches, filters and closes alerts once and returns the process
+// exit code: 1 on error, 2 when the fetched dataset is incomplete, 130 when
+// interrupted.
+func runOnce(ctx context.Context, config JsonConfig, client *http.Client) int {
+	runAt := time.Now()
+	run := NewRun(config)
+	if config.Debug {
+		fmt.Println("Run ID:", run.Metadata.RunID)
+	}
 
-	err := flushMgr.Finalize()
+	flushMgr := NewFlushManager(config.Outfile, config.FlushEvery, config.OutputFormat, CompressionFor(config.Outfile, config.Compression), config.Debug)
+	flushMgr.SetSplit(config.SplitEvery, int64(config.SplitEveryMB)<<20)
+	flushMgr.SetRun(run)
+	var cp *Checkpoint
+	if config.Checkpoint {
+		cp = LoadCheckpoint(config.Outfile, config)
+		// The fetch window ends at the start of the run being resumed, so
+		// that the page keys of the checkpoint still match.
+		runAt = cp.RunAt(runAt)
+		if err := flushMgr.EnableCheckpoint(cp); err != nil {
+			fmt.Println("CHECKPOINT ERROR:", err)
+			return 1
+		}
+	}
+	pipeline := NewPipeline(config, run, flushMgr)
+	if config.StoreFile != "" {
+		store, err := OpenStore(config.StoreFile)
+		if err != nil {
+			fmt.Println("STORE ERROR:", err)
+			return 1
+		}
+		defer store.Close()
+		pipeline.SaveTo(store)
+	}
+	audit, err := openAudit(config, run)
 	if err != nil {
-		fmt.Println("FLUSH FINALIZE ERROR:", err)
-		os.Exit(1)
+		fmt.Println("AUDIT ERROR:", err)
+		return 1
+	}
+	defer audit.Close()
+	if audit != nil {
+		closed, err := ClosedIDs(config.AuditLog)
+		if err != nil {
+			fmt.Println("AUDIT ERROR:", err)
+			return 1
+		}
+		pipeline.SkipClosed(closed)
 	}
+	if config.StreamClose {
+		pipeline.StreamClose(ctx, client, audit)
+	}
+	resumed := cp.Resumable()
+	if resumed {
+		pipeline.DeferFiltering()
+	}
+	report := fetchAlerts(ctx, config, client, cp, runAt, pipeline.HandlePage)
+	run.Finish(report)
 
-	fmt.Printf("Saved %d alerts to %s\n", len(allAlerts), TheConf.Outfile)
+	if err := pipeline.Err(); err != nil {
+		fmt.Println("SAVE ERROR: output not published:", err)
+		closeMatches(ctx, config, client, run, audit, pipeline, false)
+		return 1
+	}
+	// An interrupted or incomplete run publishes nothing: the previous
+	// output stays in place and the checkpoint lets the next run resume.
+	complete := report.Complete()
+	if complete {
+		if err := flushMgr.Finalize(); err != nil {
+			fmt.Println("FLUSH FINALIZE ERROR:", err)
+			return 1
+		}
+		fmt.Printf("Saved %d alerts to %s\n", flushMgr.GetTotalFlushed(), flushMgr.Path())
+	} else {
+		if err := flushMgr.Keep(); err != nil {
+			fmt.Println("FLUSH ERROR:", err)
+			return 1
+		}
+		fmt.Printf("Kept %d alerts in %s, %s is unchanged\n", flushMgr.GetTotalFlushed(), flushMgr.TempPath(), flushMgr.Path())
+	}
 
-	// Apply filters if enabled
-	if TheConf.FilterMode {
-		fmt.Println("\n=== Filtering Alerts ===")
-		filteredAlerts := FilterAlerts(allAlerts, TheConf)
+	if complete && resumed && config.FilterMode {
+		if err := pipeline.Replay(flushMgr.Path()); err != nil {
+			fmt.Println("RESUME FILTER ERROR:", err)
+			return 1
+		}
+	}
+	if err := pipeline.Finalize(complete); err != nil {
+		fmt.Println("FILTER SAVE ERROR:", err)
+		return 1
+	}
 
-		if len(filteredAlerts) > 0 {
-			err := SaveFilteredAlerts(filteredAlerts, TheConf.FilteredOutfile)
-			if err != nil {
-				fmt.Println("FILTER SAVE ERROR:", err)
-				os.Exit(1)
-			}
+	summary, closeErr := closeMatches(ctx, config, client, run, audit, pipeline, complete)
 
-			// Close filtered alerts if enabled
-			if TheConf.CloseAlerts {
-				fmt.Println("\n=== Closing Filtered Alerts ===")
-				CloseAlerts(filteredAlerts, TheConf, client)
-			}
-		} else {
+	if ctx.Err() != nil {
+		fmt.Println("Interrupted")
+		return 130
+	}
+
+	if !complete {
+		fmt.Println("ERROR: some pages could not be fetched, the previous output is kept")
+		return 2
+	}
+
+	if config.Incremental {
+		if err := saveHighWater(config, report, pipeline.HoldBack(summary), runAt); err != nil {
+			fmt.Println("STATE SAVE ERROR:", err)
+			return 1
+		}
+	}
+
+	if closeErr != nil {
+		return 1
+	}
+	return 0
+}
+
+// closeMatches closes the alerts matched by pipeline, or waits for its
+// streaming closer, and saves and returns the close summary. Nothing is
+// closed from an incomplete dataset, beyond the close limits or without
+// confirmation at a terminal; the error reports such a refusal.
+func closeMatches(ctx context.Context, config JsonConfig, client *http.Client, run *Run, audit *AuditLog, pipeline *Pipeline, complete bool) (CloseSummary, error) {
+	refused := pipeline.Refused()
+	skipped := pipeline.AlreadyClosed()
+	save := func(summary CloseSummary) CloseSummary {
+		summary.Metadata = &run.Metadata
+		summary.Result = run.Result
+		summary.Refused = refused
+		summary.AlreadyClosed = append(skipped, summary.AlreadyClosed...)
+		if err := SaveCloseSummary(summary, config.CloseSummaryFile); err != nil {
+			fmt.Println("CLOSE SUMMARY ERROR:", err)
+		}
+		return summary
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("\nSkipping %d matched alerts already closed\n", len(skipped))
+	}
+	if len(refused) > 0 {
+		fmt.Printf("\nRefusing to close %d matched alerts (severity or IsCII), see %s\n", len(refused), config.CloseSummaryFile)
+	}
+
+	filteredAlerts := pipeline.Matches()
+	if closer := pipeline.Closer(); closer != nil {
+		summary := closer.Wait()
+		if !complete {
+			fmt.Println("WARNING: alerts were closed while streaming but the fetched dataset is incomplete")
+		}
+		return save(summary), auditFailure(summary)
+	}
+	if !config.FilterMode || !config.CloseAlerts {
+		return CloseSummary{}, nil
+	}
+
+	if len(filteredAlerts) == 0 {
+		if len(refused) == 0 && len(skipped) == 0 {
 			fmt.Println("No alerts matched the filters")
+			return CloseSummary{}, nil
 		}
+		return save(CloseSummary{}), nil
+	}
+	if !complete {
+		fmt.Println("\nRefusing to close alerts: the fetched dataset is incomplete")
+		return save(notAttempted(ctx, filteredAlerts)), nil
+	}
+
+	err := checkCloseLimits(config, filteredAlerts, pipeline.Scanned())
+	if err == nil && interactive(config) && !confirmClose(ctx, filteredAlerts, config) {
+		err = fmt.Errorf("close cancelled")
+	}
+	if err != nil {
+		fmt.Println("\nRefusing to close alerts:", err)
+		return save(notAttempted(ctx, filteredAlerts)), err
+	}
+
+	fmt.Println("\n=== Closing Filtered Alerts ===")
+	summary := CloseAlerts(ctx, filteredAlerts, config, client, audit)
+	return save(summary), auditFailure(summary)
+}
+
+// auditFailure reports the audit log error that stopped the closes.
+func auditFailure(summary CloseSummary) error {
+	if summary.AuditError == "" {
+		return nil
+	}
+	return fmt.Errorf("audit log error: %s", summary.AuditError)
+}
+
+// notAttempted is the summary of alerts left open.
+func notAttempted(ctx context.Context, alerts []Alert) CloseSummary {
+	summary := CloseSummary{Interrupted: ctx.Err() != nil}
+	for _, a := range alerts {
+		summary.NotAttempted = append(summary.NotAttempted, CloseEntry{ID: a.InternalID, Name: a.Name, TenantID: a.TenantID})
+	}
+	return summary
+}
+
+// openAudit opens the close audit log when this run may close alerts.
+func openAudit(config JsonConfig, run *Run) (*AuditLog, error) {
+	if !config.FilterMode || !config.CloseAlerts {
+		return nil, nil
+	}
+	return OpenAuditLog(config.AuditLog, config.AuditHashChain, run.Metadata.RunID)
+}
+
+func saveHighWater(config JsonConfig, report FetchReport, hold map[string]time.Time, runAt time.Time) error {
+	state, err := LoadState(config.StateFile)
+	if err != nil {
+		return err
+	}
+	state.Advance(report.HighWater, hold, runAt)
+	if err := state.Save(config.StateFile); err != nil {
+		return err
+	}
+	if config.Debug {
+		fmt.Printf("Saved high-water marks to %s\n", config.StateFile)
 	}
+	return nil
 }
 
 type PageResult struct {
 	PageNum int
 	Alerts  []Alert
+	Key     string
+	Status  int
+	Last    bool
 	Err     error
 }
 
-func fetchPage(client *http.Client, config JsonConfig, pageNum int) PageResult {
+func fetchPage(ctx context.Context, client *http.Client, config JsonConfig, pageNum int) PageResult {
 	result := PageResult{PageNum: pageNum}
 
 	fullURL := BuildURL(config, pageNum)
@@ -84,7 +333,7 @@ func fetchPage(client *http.Client, config JsonConfig, pageNum int) PageResult {
 		fmt.Printf("Fetching page %d: %s\n", pageNum, fullURL)
 	}
 
-	req, err := http.NewRequest("GET", fullURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", fullURL, nil)
 	if err != nil {
 		result.Err = fmt.Errorf("request error on page %d: %w", pageNum, err)
 		return result
@@ -99,13 +348,14 @@ func fetchPage(client *http.Client, config JsonConfig, pageNum int) PageResult {
 	}
 	defer resp.Body.Close()
 
+	result.Status = resp.StatusCode
 	if resp.StatusCode != 200 {
 		body, _ := io.ReadAll(resp.Body)
 		result.Err = fmt.Errorf("HTTP %d on page %d: %s", resp.StatusCode, pageNum, string(body))
 		return result
 	}
 
-	var chunk AlertsFile
+	var chunk AlertsPage
 	dec := json.NewDecoder(resp.Body)
 	if err := dec.Decode(&chunk); err != nil {
 		result.Err = fmt.Errorf("JSON error on page %d: %w", pageNum, err)
@@ -113,125 +363,148 @@ func fetchPage(client *http.Client, config JsonConfig, pageNum int) PageResult {
 	}
 
 	result.Alerts = chunk.Alerts
+	result.Last = isLastPage(chunk, pageNum-config.PageNumber+1)
 	return result
 }
 
-func fetchAllAlertsParallel(config JsonConfig, client *http.Client) []Alert {
-	var allAlerts []Alert
-	var mu sync.Mutex
+// isLastPage prefers the pagination metadata returned by the server and
+// falls back to an empty page. index counts pages from 1. With Total the
+// page stride is the number of alerts the server returned, not pageSize,
+// which the server may cap; a short page gives a smaller stride and so is
+// never mistaken for the end.
+func isLastPage(chunk AlertsPage, index int) bool {
+	if chunk.Next != nil {
+		return *chunk.Next == ""
+	}
+	if len(chunk.Alerts) == 0 {
+		return true
+	}
+	if chunk.Total != nil {
+		return index*len(chunk.Alerts) >= *chunk.Total
+	}
+	return false
+}
+
+// fetchPages runs MaxConcurrentPages workers over the page sequence and
+// passes every successful page to handle, one at a time.
+// Pages already recorded in cp are not fetched again.
+// Once ctx is cancelled no new page is started.
+func fetchPages(ctx context.Context, config JsonConfig, client *http.Client, cp *Checkpoint, handle func(PageResult)) FetchReport {
 	var wg sync.WaitGroup
 
-	currentPage := config.PageNumber
-	semaphore := make(chan struct{}, config.MaxConcurrentPages)
+	tracker := NewPageTracker(config.PageNumber, config.MaxConcurrentPages)
 	results := make(chan PageResult, config.MaxConcurrentPages)
 	done := make(chan bool)
 
 	go func() {
 		for result := range results {
-			if result.Err != nil {
-				fmt.Printf("Error: %v\n", result.Err)
-				continue
-			}
-
-			mu.Lock()
-			allAlerts = append(allAlerts, result.Alerts...)
-			mu.Unlock()
-
-			if config.Debug {
-				fmt.Printf("Page %d completed: %d alerts\n", result.PageNum, len(result.Alerts))
-			}
-
-			if len(result.Alerts) == 100 {
-				wg.Add(1)
-				go func(page int) {
-					semaphore <- struct{}{}
-					fetchResult := fetchPage(client, config, page)
-					results <- fetchResult
-					<-semaphore
-					wg.Done()
-				}(result.PageNum + config.MaxConcurrentPages)
-			}
+			handle(result)
 		}
 		done <- true
 	}()
 
 	for i := 0; i < config.MaxConcurrentPages; i++ {
 		wg.Add(1)
-		go func(page int) {
-			semaphore <- struct{}{}
-			result := fetchPage(client, config, page)
-			results <- result
-			<-semaphore
-			wg.Done()
-		}(currentPage + i)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				page, ok := tracker.Next()
+				if !ok {
+					return
+				}
+				key := pageKey(config, page)
+				if saved, ok := cp.Page(key); ok {
+					tracker.Done(page, saved.Alerts, saved.Last)
+					continue
+				}
+				result := fetchPageWithRetry(ctx, client, config, page)
+				result.Key = key
+				if result.Err != nil && ctx.Err() != nil {
+					// Left pending, reported as a gap.
+					return
+				}
+				if result.Err != nil {
+					fmt.Printf("Error: %v\n", result.Err)
+					tracker.Fail(page, result.Err)
+					continue
+				}
+				tracker.Done(page, len(result.Alerts), result.Last)
+				results <- result
+			}
+		}()
 	}
 
 	wg.Wait()
 	close(results)
 	<-done
 
-	fmt.Printf("Total alerts fetched: %d\n", len(allAlerts))
-	return allAlerts
+	return tracker.Report()
 }
 
-func fetchAllAlertsParallelWithFlush(config JsonConfig, client *http.Client, flushMgr *FlushManager) []Alert {
-	var allAlerts []Alert
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-
-	currentPage := config.PageNumber
-	semaphore := make(chan struct{}, config.MaxConcurrentPages)
-	results := make(chan PageResult, config.MaxConcurrentPages)
-	done := make(chan bool)
-
-	go func() {
-		for result := range results {
-			if result.Err != nil {
-				fmt.Printf("Error: %v\n", result.Err)
-				continue
+// fetchAlerts runs the configured fetch strategy and drops alerts already
+// seen under the same InternalID, which happens when the result set shifts
+// during pagination or at window boundaries. In incremental mode each tenant
+// is fetched from its own high-water mark up to runAt, so that alerts
+// changed while the run goes on are left to the next run. The windows
+// strategy without toDate also stops at runAt.
+func fetchAlerts(ctx context.Context, config JsonConfig, client *http.Client, cp *Checkpoint, runAt time.Time, handle func(PageResult)) FetchReport {
+	seen := make(map[string]struct{})
+	duplicates := 0
+	highWater := make(map[string]time.Time)
+	dedup := func(result PageResult) {
+		alerts := result.Alerts[:0]
+		for _, alert := range result.Alerts {
+			if alert.InternalID != "" {
+				if _, ok := seen[alert.InternalID]; ok {
+					duplicates++
+					continue
+				}
+				seen[alert.InternalID] = struct{}{}
 			}
-
-			mu.Lock()
-			allAlerts = append(allAlerts, result.Alerts...)
-			mu.Unlock()
-
-			if err := flushMgr.AddAlerts(result.Alerts); err != nil {
-				fmt.Printf("Flush error: %v\n", err)
+			if ts, ok := alertTimestamp(alert); ok && ts.After(highWater[alert.TenantID]) {
+				highWater[alert.TenantID] = ts
 			}
+			alerts = append(alerts, alert)
+		}
+		result.Alerts = alerts
+		handle(result)
+	}
 
+	var report FetchReport
+	if config.Incremental {
+		state, err := LoadState(config.StateFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			report.Aborted = true
+			return report
+		}
+		for _, tenant := range strings.Split(config.TenantID, ",") {
+			conf := config
+			conf.TenantID = strings.TrimSpace(tenant)
+			conf.FromDate = cp.FromDate(conf.TenantID, state.FromDate(conf.TenantID, config.FromDate))
+			conf.ToDate = windowEnd(config.ToDate, runAt)
 			if config.Debug {
-				fmt.Printf("Page %d completed: %d alerts (total in memory: %d)\n", result.PageNum, len(result.Alerts), len(allAlerts))
-			}
-
-			if len(result.Alerts) == 100 {
-				wg.Add(1)
-				go func(page int) {
-					semaphore <- struct{}{}
-					fetchResult := fetchPage(client, config, page)
-					results <- fetchResult
-					<-semaphore
-					wg.Done()
-				}(result.PageNum + config.MaxConcurrentPages)
+				fmt.Printf("Incremental fetch for tenant %s from %q to %q\n", conf.TenantID, conf.FromDate, conf.ToDate)
 			}
+			report.Merge(fetchStrategy(ctx, conf, client, cp, dedup))
 		}
-		done <- true
-	}()
-
-	for i := 0; i < config.MaxConcurrentPages; i++ {
-		wg.Add(1)
-		go func(page int) {
-			semaphore <- struct{}{}
-			result := fetchPage(client, config, page)
-			results <- result
-			<-semaphore
-			wg.Done()
-		}(currentPage + i)
+	} else {
+		if config.FetchStrategy == "windows" && config.ToDate == "" {
+			config.ToDate = windowEnd("", runAt)
+		}
+		report = fetchStrategy(ctx, config, client, cp, dedup)
 	}
+	report.Duplicates = duplicates
+	report.Alerts -= duplicates
+	report.Interrupted = ctx.Err() != nil
+	report.HighWater = highWater
+	report.Print()
+	return report
+}
 
-	wg.Wait()
-	close(results)
-	<-done
-
-	fmt.Printf("Total alerts fetched: %d\n", len(allAlerts))
-	return allAlerts
+func fetchStrategy(ctx context.Context, config JsonConfig, client *http.Client, cp *Checkpoint, handle func(PageResult)) FetchReport {
+	if config.FetchStrategy == "windows" {
+		return fetchWindows(ctx, config, client, cp, handle)
+	}
+	return fetchPages(ctx, config, client, cp, handle)
 }
@@ -4,6 +4,14 @@ type AlertsFile struct {
 	Alerts []Alert `json:"Alerts"`
 }
 
+// AlertsPage is one page of the alerts listing, with the optional
+// pagination metadata some XDR versions return.
+type AlertsPage struct {
+	Alerts []Alert `json:"Alerts"`
+	Total  *int    `json:"Total"`
+	Next   *string `json:"Next"`
+}
+
 type Alert struct {
 	Assets                interface{}     `json:"Assets"`
 	Assignee              Assignee        `json:"Assignee"`
@@ -33,6 +41,9 @@ type Alert struct {
 	StatusResolution      string          `json:"StatusResolution"`
 	TenantID              string          `json:"TenantID"`
 	UpdatedAt             string          `json:"UpdatedAt"`
+
+	// suppression is the rule that selected the alert for closing.
+	suppression *Suppression
 }
 
 type Assignee struct {